@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"google.golang.org/api/calendar/v3"
+)
+
+var accountsCmd = &command{
+	name:  "accounts",
+	args:  "add|list|remove|reauth [flags] [args]",
+	short: "add, list, remove and reauthorize accounts",
+	long: `
+Accounts manages the accounts in the config file. The subcommands are:
+
+  add      authorize a new account and add it to the config file
+  list     show the accounts and the state of their tokens
+  remove   take an account out of the config and delete its tokens
+  reauth   authorize an account again, like 'gcalorg auth'
+
+Run 'gcalorg accounts <subcommand> -help' for their flags.
+`,
+	run: runAccounts,
+}
+
+var accountsAddCmd = &command{
+	name:  "accounts add",
+	args:  "[flags] <name>",
+	short: "authorize a new account and add it to the config file",
+	long: `
+Add authorizes a new account, looks up its email address from its primary
+calendar, and appends it to the config file, creating the file if there is
+none. Give --secret for a user account, or --key (and --subject) for a
+service account. Add calendars to export to the new [[account]] section
+afterwards, 'gcalorg calendars --account <name>' lists them.
+`,
+	run: runAccountsAdd,
+}
+
+var accountsListCmd = &command{
+	name:  "accounts list",
+	args:  "[flags]",
+	short: "show the accounts and the state of their tokens",
+	run:   runAccountsList,
+}
+
+var accountsRemoveCmd = &command{
+	name:  "accounts remove",
+	args:  "[flags] <name>",
+	short: "take an account out of the config and delete its tokens",
+	long: `
+Remove deletes the account's [[account]] section, with its calendars, from
+the config file, and deletes its tokens and cached events. The client
+secret or service account key is left alone.
+`,
+	run: runAccountsRemove,
+}
+
+var accountsReauthCmd = &command{
+	name:  "accounts reauth",
+	args:  authCmd.args,
+	short: "authorize an account again",
+	long:  authCmd.long,
+	run:   runAuth,
+}
+
+var accountsSubcommands = []*command{accountsAddCmd, accountsListCmd, accountsRemoveCmd, accountsReauthCmd}
+
+func runAccounts(cmd *command, args []string) error {
+	if len(args) == 0 {
+		cmd.usage(os.Stderr)
+		return usageError(fmt.Errorf("expected a subcommand"))
+	}
+	switch args[0] {
+	case "-h", "-help", "--help":
+		cmd.usage(os.Stdout)
+		return flag.ErrHelp
+	}
+	for _, sub := range accountsSubcommands {
+		if sub.name == cmd.name+" "+args[0] {
+			return sub.run(sub, args[1:])
+		}
+	}
+	return usageError(fmt.Errorf("unknown subcommand %q", args[0]))
+}
+
+// newAccountEntry is the [[account]] section add writes.
+type newAccountEntry struct {
+	Name    string `toml:"name"`
+	Label   string `toml:"label,omitempty"`
+	Email   string `toml:"email,omitempty"`
+	Type    string `toml:"type,omitempty"`
+	Secret  string `toml:"secret,omitempty"`
+	Key     string `toml:"key,omitempty"`
+	Subject string `toml:"subject,omitempty"`
+	Tag     string `toml:"tag,omitempty"`
+}
+
+func runAccountsAdd(cmd *command, args []string) error {
+	fs := cmd.flags()
+	configPath := configFlag(fs)
+	label := fs.String("label", "", "description of the account")
+	secret := fs.String("secret", "", "client secret file of an installed app")
+	key := fs.String("key", "", "key file of a service account")
+	subject := fs.String("subject", "", "user a service account acts as")
+	tag := fs.String("tag", "", "default org tag of the account's calendars")
+	noBrowser := fs.Bool("no-browser", false, "print the authorization link instead of opening a browser")
+	if err := cmd.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return usageError(fmt.Errorf("expected one account name"))
+	}
+	if (*secret == "") == (*key == "") {
+		return usageError(fmt.Errorf("give one of --secret and --key"))
+	}
+	if *subject != "" && *key == "" {
+		return usageError(fmt.Errorf("--subject is for service accounts"))
+	}
+
+	entry := newAccountEntry{Name: fs.Arg(0), Label: *label, Subject: *subject, Tag: *tag}
+	var err error
+	if *secret != "" {
+		entry.Secret, err = filepath.Abs(*secret)
+	} else {
+		entry.Type = serviceAccount
+		entry.Key, err = filepath.Abs(*key)
+	}
+	if err != nil {
+		return usageError(err)
+	}
+
+	path := *configPath
+	if path == "" {
+		if path, err = defaultConfigPath(); err != nil {
+			return configError(err)
+		}
+	}
+	conf := &config{path: path}
+	if _, err := os.Stat(path); err == nil {
+		if conf, err = decodeConfig(path); err != nil {
+			return configError(err)
+		}
+	}
+	if _, err := conf.account(entry.Name); err == nil {
+		return usageError(fmt.Errorf("there already is an account named %q", entry.Name))
+	}
+
+	// Validating fills in the token store and absolute paths.
+	acct := &account{Name: entry.Name, Type: entry.Type, Secret: entry.Secret, Key: entry.Key,
+		Subject: entry.Subject, Tag: entry.Tag}
+	conf.Accounts = append(conf.Accounts, acct)
+	if err := conf.validate(); err != nil {
+		return configError(err)
+	}
+
+	if acct.Type == oauthAccount {
+		config, err := oauthConfig(acct.Secret, calendar.CalendarReadonlyScope)
+		if err != nil {
+			return err
+		}
+		if _, err := authorize(acct, config, nil, !*noBrowser); err != nil {
+			return err
+		}
+	}
+
+	if entry.Email, err = primaryEmail(acct); err != nil {
+		return err
+	}
+	if err := appendAccount(path, entry); err != nil {
+		return configError(err)
+	}
+	fmt.Fprintf(os.Stderr, "added %s (%s) to %s\n", entry.Name, entry.Email, path)
+	return nil
+}
+
+// primaryEmail returns the id of the account's primary calendar, which is
+// the address of the user.
+func primaryEmail(acct *account) (string, error) {
+	client, err := genClient(acct, calendar.CalendarReadonlyScope)
+	if err != nil {
+		return "", err
+	}
+	srv, err := calendar.New(client)
+	if err != nil {
+		return "", apiError(fmt.Errorf("unable to create calendar client: %w", err))
+	}
+	primary, err := srv.CalendarList.Get("primary").Do()
+	if err != nil {
+		return "", apiError(fmt.Errorf("unable to get primary calendar: %w", err))
+	}
+	return primary.Id, nil
+}
+
+// appendAccount adds an [[account]] section for entry to the end of the
+// config file at path, leaving the rest of it as it was.
+func appendAccount(path string, entry newAccountEntry) error {
+	old, perm, err := readConfigText(path)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := toml.NewEncoder(&buf)
+	enc.Indent = ""
+	if err := enc.Encode(map[string][]newAccountEntry{"account": {entry}}); err != nil {
+		return err
+	}
+	text := strings.TrimRight(string(old), "\n")
+	if text != "" {
+		text += "\n\n"
+	}
+	text += buf.String()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, []byte(text), perm)
+}
+
+// readConfigText returns the text of the config file at path and its
+// permissions. A missing file is empty.
+func readConfigText(path string) ([]byte, os.FileMode, error) {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, 0600, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	b, err := ioutil.ReadFile(path)
+	return b, fi.Mode().Perm(), err
+}
+
+func runAccountsList(cmd *command, args []string) error {
+	fs := cmd.flags()
+	configPath := configFlag(fs)
+	if err := cmd.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usageError(fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " ")))
+	}
+	conf, err := loadConfig(*configPath)
+	if err != nil {
+		return configError(err)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "ACCOUNT\tLABEL\tEMAIL\tTAG\tCALENDARS\tCREDENTIALS\tTOKEN\tSCOPES\n")
+	for _, acct := range conf.Accounts {
+		creds := acct.Secret
+		if acct.Type == serviceAccount {
+			creds = acct.Key
+			if acct.Subject != "" {
+				creds += " as " + acct.Subject
+			}
+		}
+		status, scopes := tokenStatus(acct)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", acct.Name, acct.Label, acct.Email,
+			acct.Tag, len(acct.Calendars), creds, status, scopes)
+	}
+	return tw.Flush()
+}
+
+// tokenStatus describes the account's token and the scopes it was granted,
+// without talking to google.
+func tokenStatus(acct *account) (status, scopes string) {
+	if acct.Type == serviceAccount {
+		return "service account", "-"
+	}
+	tok, err := acct.tokens.load(acct.Name)
+	if errors.Is(err, os.ErrNotExist) {
+		if path, err := legacyTokenFile(acct); err == nil {
+			if _, err := os.Stat(path); err == nil {
+				return "in ~/.credentials", "-"
+			}
+		}
+		return "none", "-"
+	}
+	if err != nil {
+		return "unreadable", "-"
+	}
+
+	short := make([]string, len(tok.Scopes))
+	for i, s := range tok.Scopes {
+		short[i] = shortScope(s)
+	}
+	scopes = strings.Join(short, ",")
+	if scopes == "" {
+		scopes = "-"
+	}
+	switch {
+	case !tok.Expiry.IsZero() && tok.Expiry.After(time.Now()):
+		status = "valid until " + tok.Expiry.Local().Format("2006-01-02 15:04")
+	case tok.RefreshToken != "":
+		status = "refreshes on use"
+	default:
+		status = "expired"
+	}
+	return status, scopes
+}
+
+func runAccountsRemove(cmd *command, args []string) error {
+	fs := cmd.flags()
+	configPath := configFlag(fs)
+	if err := cmd.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return usageError(fmt.Errorf("expected one account name"))
+	}
+	conf, err := loadConfig(*configPath)
+	if err != nil {
+		return configError(err)
+	}
+	acct, err := conf.account(fs.Arg(0))
+	if err != nil {
+		return configError(err)
+	}
+
+	old, perm, err := readConfigText(conf.path)
+	if err != nil {
+		return configError(err)
+	}
+	text, err := removeAccountSection(string(old), acct.Name)
+	if err != nil {
+		return configError(fmt.Errorf("%s: %v, remove it by hand", conf.path, err))
+	}
+	// Make sure we cut out just that account before writing.
+	var check config
+	if _, err := toml.Decode(text, &check); err != nil || len(check.Accounts) != len(conf.Accounts)-1 {
+		return configError(fmt.Errorf("%s: unable to cut out account %q, remove it by hand", conf.path, acct.Name))
+	}
+	if err := writeFileAtomic(conf.path, []byte(text), perm); err != nil {
+		return configError(err)
+	}
+
+	if acct.Type == oauthAccount {
+		if _, err := acct.tokens.load(acct.Name); !errors.Is(err, os.ErrNotExist) {
+			if err := acct.tokens.remove(acct.Name); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: unable to delete token: %v\n", acct.Name, err)
+			}
+		}
+	}
+	if dir, err := cacheDir(); err == nil {
+		os.RemoveAll(filepath.Join(dir, url.PathEscape(acct.Name)))
+	}
+	fmt.Fprintf(os.Stderr, "removed %s from %s\n", acct.Name, conf.path)
+	return nil
+}
+
+var (
+	tableHeaderRE  = regexp.MustCompile(`^\s*\[`)
+	accountStartRE = regexp.MustCompile(`^\s*\[\[\s*account\s*\]\]`)
+	subTableRE     = regexp.MustCompile(`^\s*\[\[?\s*account\.`)
+	nameKeyRE      = regexp.MustCompile(`^\s*name\s*=\s*["']([^"']*)["']`)
+)
+
+// removeAccountSection cuts the [[account]] section called name, with its
+// calendars and the comments right above it, out of the config text.
+func removeAccountSection(text, name string) (string, error) {
+	lines := strings.SplitAfter(text, "\n")
+	isComment := func(l string) bool { return strings.HasPrefix(strings.TrimSpace(l), "#") }
+
+	start, end := -1, len(lines)
+	header := -1 // of the [[account]] we're in, if not in a subtable
+	for i, l := range lines {
+		switch {
+		case accountStartRE.MatchString(l):
+			if start >= 0 {
+				end = i
+				break
+			}
+			header = i
+			continue
+		case subTableRE.MatchString(l):
+			header = -1
+			continue
+		case tableHeaderRE.MatchString(l):
+			if start >= 0 {
+				end = i
+				break
+			}
+			header = -1
+			continue
+		}
+		if end < len(lines) {
+			break
+		}
+		if m := nameKeyRE.FindStringSubmatch(l); m != nil && header >= 0 && m[1] == name {
+			start = header
+		}
+	}
+	if start < 0 {
+		return "", fmt.Errorf("no [[account]] section named %q", name)
+	}
+
+	// Comments right above a header go with it.
+	for start > 0 && isComment(lines[start-1]) {
+		start--
+	}
+	if end < len(lines) {
+		for end > start && isComment(lines[end-1]) {
+			end--
+		}
+	}
+	rest := append(lines[:start:start], lines[end:]...)
+	out := strings.Join(rest, "")
+	for strings.Contains(out, "\n\n\n") {
+		out = strings.Replace(out, "\n\n\n", "\n\n", -1)
+	}
+	if out = strings.TrimRight(out, "\n"); out != "" {
+		out += "\n"
+	}
+	return out, nil
+}
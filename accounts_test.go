@@ -0,0 +1,114 @@
+package main
+
+import "testing"
+
+func TestRemoveAccountSection(t *testing.T) {
+	const config = `fail_fast = false
+
+# personal stuff
+[[account]]
+name = "home"
+credentials = "~/home.json"
+
+[[account.calendar]]
+id = "home@x.com"
+tag = "HOME"
+
+# the office
+[[account]]
+name = 'work'
+
+[[account.calendar]]
+id = "work@x.com"
+name = "home"
+
+[retry]
+max_retries = 3
+`
+	tests := []struct {
+		name    string
+		text    string
+		account string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "first",
+			text:    config,
+			account: "home",
+			want: `fail_fast = false
+
+# the office
+[[account]]
+name = 'work'
+
+[[account.calendar]]
+id = "work@x.com"
+name = "home"
+
+[retry]
+max_retries = 3
+`,
+		},
+		{
+			name:    "before another table",
+			text:    config,
+			account: "work",
+			want: `fail_fast = false
+
+# personal stuff
+[[account]]
+name = "home"
+credentials = "~/home.json"
+
+[[account.calendar]]
+id = "home@x.com"
+tag = "HOME"
+
+[retry]
+max_retries = 3
+`,
+		},
+		{
+			name:    "last in the file",
+			text:    "[[account]]\nname = \"a\"\n\n[[account]]\nname = \"b\"\n[[account.calendar]]\nid = \"b@x.com\"\n",
+			account: "b",
+			want:    "[[account]]\nname = \"a\"\n",
+		},
+		{
+			name:    "only one",
+			text:    "[[account]]\nname = \"a\"\n",
+			account: "a",
+			want:    "",
+		},
+		{
+			name:    "name of a calendar",
+			text:    "[[account]]\nname = \"a\"\n[[account.calendar]]\nname = \"b\"\n",
+			account: "b",
+			wantErr: true,
+		},
+		{
+			name:    "missing",
+			text:    config,
+			account: "school",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := removeAccountSection(tt.text, tt.account)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("removeAccountSection(%q) = %q, want an error", tt.account, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("removeAccountSection(%q): %v", tt.account, err)
+			}
+			if got != tt.want {
+				t.Errorf("removeAccountSection(%q) =\n%s\nwant\n%s", tt.account, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// eventCache is what we keep of a calendar between runs: every event we know
+// about and the sync token to ask for changes since.
+type eventCache struct {
+	Version    int    `json:"version"`
+	CalendarID string `json:"calendarId"`
+	SyncToken  string `json:"syncToken"`
+
+	// TimeMin and TimeMax are the window of the last full sync. The sync
+	// token only works for the same query, so a new window means a new
+	// full sync.
+	TimeMin string `json:"timeMin"`
+	TimeMax string `json:"timeMax"`
+
+	Synced time.Time `json:"synced"`
+
+	// Events holds single events, the masters of recurring events and
+	// their modified or cancelled occurrences, by event id.
+	Events map[string]*calendar.Event `json:"events"`
+
+	// Instances holds the occurrences in the window of recurring events
+	// org repeaters can't express, by master event id.
+	Instances map[string][]*calendar.Event `json:"instances"`
+
+	// Deleted are the iCalUIDs of the events an incremental sync saw
+	// deleted, with when it did, so --merge can tell them from events
+	// that only left the window. They're kept for deletedKeep.
+	Deleted map[string]time.Time `json:"deleted"`
+}
+
+// deletedKeep is how long deletions are remembered.
+const deletedKeep = 30 * 24 * time.Hour
+
+// eventCacheVersion changes when the cache holds something different, so old
+// caches get a full sync.
+const eventCacheVersion = 1
+
+// cacheDir returns $XDG_CACHE_HOME/gcalorg.
+func cacheDir() (string, error) {
+	dir, err := xdgDir("XDG_CACHE_HOME", ".cache")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gcalorg"), nil
+}
+
+// eventCachePath returns where the events of calendar calid in account acct
+// are cached.
+func eventCachePath(acct *account, calid string) (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, url.PathEscape(acct.Name), url.PathEscape(calid)+".json"), nil
+}
+
+// loadEventCache reads the cache at path. A missing or unreadable cache is
+// an empty one; the next sync just has to be a full one.
+func loadEventCache(path, calid string) *eventCache {
+	c := &eventCache{CalendarID: calid}
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(b, c)
+	}
+	if err != nil || c.CalendarID != calid {
+		c = &eventCache{CalendarID: calid}
+	}
+	if c.Events == nil {
+		c.Events = make(map[string]*calendar.Event)
+	}
+	if c.Instances == nil {
+		c.Instances = make(map[string][]*calendar.Event)
+	}
+	if c.Deleted == nil {
+		c.Deleted = make(map[string]time.Time)
+	}
+	return c
+}
+
+func (c *eventCache) save(path string) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b, 0600)
+}
+
+// events returns the cached events that overlap window, ordered by start.
+// Recurring events org can repeat come as their master and its exceptions,
+// others as their instances.
+func (c *eventCache) events(window timeWindow) []*calendar.Event {
+	overlaps := func(e *calendar.Event) bool {
+		start, end := eventStart(e), eventEnd(e)
+		return start.IsZero() || (end.After(window.min) && start.Before(window.max))
+	}
+
+	var events []*calendar.Event
+	for _, e := range c.Events {
+		switch {
+		case e.RecurringEventId != "":
+			if master, ok := c.Events[e.RecurringEventId]; ok {
+				if _, ok := parseRecurrence(master); !ok {
+					// Listed with the instances.
+					continue
+				}
+			}
+			if overlaps(e) {
+				events = append(events, e)
+			}
+		case len(e.Recurrence) > 0:
+			if _, ok := parseRecurrence(e); ok {
+				if eventStart(e).Before(window.max) {
+					events = append(events, e)
+				}
+				continue
+			}
+			for _, inst := range c.Instances[e.Id] {
+				if inst.Status != "cancelled" && overlaps(inst) {
+					events = append(events, inst)
+				}
+			}
+		default:
+			if overlaps(e) {
+				events = append(events, e)
+			}
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		si, sj := eventStart(events[i]), eventStart(events[j])
+		if !si.Equal(sj) {
+			return si.Before(sj)
+		}
+		return events[i].Id < events[j].Id
+	})
+	return events
+}
+
+// syncEvents brings the cache of calendar calid up to date and returns it.
+// With a usable sync token only the changes since the last run are fetched;
+// otherwise, or when full is set, the whole window is.
+func syncEvents(ctx context.Context, srv *calendar.Service, acct *account, calid string,
+	window timeWindow, full bool) (*eventCache, error) {
+	path, err := eventCachePath(acct, calid)
+	if err != nil {
+		return nil, err
+	}
+	cache := loadEventCache(path, calid)
+
+	if full || cache.SyncToken == "" || cache.Version != eventCacheVersion ||
+		cache.TimeMin != window.apiMin() || cache.TimeMax != window.apiMax() {
+		err = cache.fullSync(ctx, srv, window)
+	} else {
+		err = cache.incrementalSync(ctx, srv)
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && gerr.Code == 410 {
+			// The sync token expired, start over.
+			err = cache.fullSync(ctx, srv, window)
+		}
+	}
+	if err != nil {
+		return nil, apiError(fmt.Errorf("unable to retrieve events for %s: %w", calid, err))
+	}
+
+	cache.Synced = time.Now()
+	for uid, when := range cache.Deleted {
+		if cache.Synced.Sub(when) > deletedKeep {
+			delete(cache.Deleted, uid)
+		}
+	}
+	if err := cache.save(path); err != nil {
+		return nil, fmt.Errorf("unable to save event cache: %w", err)
+	}
+	return cache, nil
+}
+
+func (c *eventCache) fullSync(ctx context.Context, srv *calendar.Service, window timeWindow) error {
+	events := make(map[string]*calendar.Event)
+	npt := ""
+	for {
+		// Cancelled occurrences of recurring events are still
+		// listed, they're what org can't otherwise know about.
+		req := srv.Events.List(c.CalendarID).ShowDeleted(false).SingleEvents(false).
+			TimeMin(window.apiMin()).TimeMax(window.apiMax()).MaxResults(250)
+		if npt != "" {
+			req = req.PageToken(npt)
+		}
+		list, err := req.Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		for _, e := range list.Items {
+			events[e.Id] = e
+		}
+		if list.NextPageToken == "" {
+			c.SyncToken = list.NextSyncToken
+			break
+		}
+		npt = list.NextPageToken
+	}
+
+	c.Version = eventCacheVersion
+	c.Events = events
+	c.Instances = make(map[string][]*calendar.Event)
+	c.TimeMin, c.TimeMax = window.apiMin(), window.apiMax()
+	changed := make(map[string]bool)
+	for id := range events {
+		changed[id] = true
+	}
+	return c.expandInstances(ctx, srv, changed)
+}
+
+func (c *eventCache) incrementalSync(ctx context.Context, srv *calendar.Service) error {
+	// Apply changes to a copy, so a failure halfway leaves the cache as it
+	// was for the next run.
+	events := make(map[string]*calendar.Event, len(c.Events))
+	for id, e := range c.Events {
+		events[id] = e
+	}
+	instances := make(map[string][]*calendar.Event, len(c.Instances))
+	for id, insts := range c.Instances {
+		instances[id] = insts
+	}
+	deleted := make(map[string]time.Time, len(c.Deleted))
+	for uid, when := range c.Deleted {
+		deleted[uid] = when
+	}
+	now := time.Now()
+
+	// changed collects the recurring events whose instances may need
+	// fetching again.
+	changed := make(map[string]bool)
+	npt := ""
+	var syncToken string
+	for {
+		req := srv.Events.List(c.CalendarID).SingleEvents(false).
+			SyncToken(c.SyncToken).MaxResults(250)
+		if npt != "" {
+			req = req.PageToken(npt)
+		}
+		list, err := req.Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		for _, e := range list.Items {
+			if e.RecurringEventId != "" {
+				// Modified or cancelled occurrence.
+				events[e.Id] = e
+				changed[e.RecurringEventId] = true
+				continue
+			}
+			if e.Status == "cancelled" {
+				// Deletions may only come with the id.
+				if uid := e.ICalUID; uid != "" {
+					deleted[uid] = now
+				} else if old, ok := events[e.Id]; ok && old.ICalUID != "" {
+					deleted[old.ICalUID] = now
+				}
+				delete(events, e.Id)
+				delete(instances, e.Id)
+				for id, ex := range events {
+					if ex.RecurringEventId == e.Id {
+						delete(events, id)
+					}
+				}
+				continue
+			}
+			events[e.Id] = e
+			changed[e.Id] = true
+			delete(deleted, e.ICalUID)
+		}
+		if list.NextPageToken == "" {
+			syncToken = list.NextSyncToken
+			break
+		}
+		npt = list.NextPageToken
+	}
+
+	oldEvents, oldInstances := c.Events, c.Instances
+	c.Events, c.Instances = events, instances
+	if err := c.expandInstances(ctx, srv, changed); err != nil {
+		c.Events, c.Instances = oldEvents, oldInstances
+		return err
+	}
+	c.SyncToken = syncToken
+	c.Deleted = deleted
+	return nil
+}
+
+// expandInstances fetches the instances of the changed recurring events org
+// can't repeat, and drops those of the ones it can.
+func (c *eventCache) expandInstances(ctx context.Context, srv *calendar.Service, changed map[string]bool) error {
+	ids := make([]string, 0, len(changed))
+	for id := range changed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		master, ok := c.Events[id]
+		if !ok || len(master.Recurrence) == 0 {
+			continue
+		}
+		if _, ok := parseRecurrence(master); ok {
+			delete(c.Instances, id)
+			continue
+		}
+
+		var instances []*calendar.Event
+		npt := ""
+		for {
+			req := srv.Events.Instances(c.CalendarID, id).ShowDeleted(false).
+				TimeMin(c.TimeMin).TimeMax(c.TimeMax).MaxResults(250)
+			if npt != "" {
+				req = req.PageToken(npt)
+			}
+			list, err := req.Context(ctx).Do()
+			if err != nil {
+				return err
+			}
+			instances = append(instances, list.Items...)
+			if list.NextPageToken == "" {
+				break
+			}
+			npt = list.NextPageToken
+		}
+		c.Instances[id] = instances
+	}
+	return nil
+}
+
+// calendarList is the snapshot of an account's calendar list, kept so the
+// account can be rendered without talking to the API.
+type calendarList struct {
+	Fetched   time.Time                     `json:"fetched"`
+	Calendars []*calendar.CalendarListEntry `json:"calendars"`
+}
+
+// calendarListPath returns where the calendar list of acct is kept. Calendar
+// ids all have an @ in them, so this can't clash with an event cache.
+func calendarListPath(acct *account) (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, url.PathEscape(acct.Name), "calendarList.json"), nil
+}
+
+func saveCalendarList(acct *account, calendars []*calendar.CalendarListEntry) error {
+	path, err := calendarListPath(acct)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&calendarList{Fetched: time.Now(), Calendars: calendars})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b, 0600)
+}
+
+func loadCalendarList(acct *account) (*calendarList, error) {
+	path, err := calendarListPath(acct)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	list := &calendarList{}
+	if err := json.Unmarshal(b, list); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return list, nil
+}
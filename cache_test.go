@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/calendar/v3"
+)
+
+func TestSyncEvents(t *testing.T) {
+	window := timeWindow{
+		min: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+		max: time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC),
+	}
+	event := func(id string) *calendar.Event {
+		return &calendar.Event{
+			Id: id, ICalUID: id + "@google.com", Summary: id, Status: "confirmed",
+			Start: &calendar.EventDateTime{DateTime: "2026-10-17T10:00:00Z"},
+			End:   &calendar.EventDateTime{DateTime: "2026-10-17T11:00:00Z"},
+		}
+	}
+	tests := []struct {
+		name string
+		// cachedWindow is the window of the cached full sync.
+		cachedWindow timeWindow
+		// changes answers the incremental sync; nil fails it with 410 Gone.
+		changes []*calendar.Event
+		// full answers a full sync.
+		full []*calendar.Event
+
+		wantQueries []string // "full" or "incremental"
+		wantEvents  []string
+		wantDeleted []string
+		wantToken   string
+	}{
+		{
+			name:         "deletions",
+			cachedWindow: window,
+			changes: []*calendar.Event{
+				{Id: "a1", Status: "cancelled"},
+				event("c1"),
+			},
+			wantQueries: []string{"incremental"},
+			wantEvents:  []string{"b1", "c1"},
+			wantDeleted: []string{"a1@google.com"},
+			wantToken:   "incremental",
+		},
+		{
+			name:         "expired sync token",
+			cachedWindow: window,
+			full:         []*calendar.Event{event("b1"), event("c1")},
+			wantQueries:  []string{"incremental", "full"},
+			wantEvents:   []string{"b1", "c1"},
+			wantToken:    "full",
+		},
+		{
+			name:         "new window",
+			cachedWindow: timeWindow{min: window.min, max: window.max.AddDate(0, 1, 0)},
+			changes:      []*calendar.Event{{Id: "a1", Status: "cancelled"}},
+			full:         []*calendar.Event{event("c1")},
+			wantQueries:  []string{"full"},
+			wantEvents:   []string{"c1"},
+			wantToken:    "full",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_CACHE_HOME", t.TempDir())
+			acct := &account{Name: "work"}
+			path, err := eventCachePath(acct, "me@x.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cache := &eventCache{
+				Version:    eventCacheVersion,
+				CalendarID: "me@x.com",
+				SyncToken:  "s1",
+				TimeMin:    tt.cachedWindow.apiMin(),
+				TimeMax:    tt.cachedWindow.apiMax(),
+				Events:     map[string]*calendar.Event{"a1": event("a1"), "b1": event("b1")},
+			}
+			if err := cache.save(path); err != nil {
+				t.Fatal(err)
+			}
+
+			var mu sync.Mutex
+			var queries []string
+			srv := fakeService(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				q := r.URL.Query()
+				list := &calendar.Events{}
+				if q.Get("syncToken") != "" {
+					mu.Lock()
+					queries = append(queries, "incremental")
+					mu.Unlock()
+					if q.Get("syncToken") != "s1" {
+						t.Errorf("incremental sync with token %q, want s1", q.Get("syncToken"))
+					}
+					if tt.changes == nil {
+						w.WriteHeader(http.StatusGone)
+						w.Write([]byte(`{"error": {"code": 410, "message": "Sync token is no longer valid"}}`))
+						return
+					}
+					list.Items, list.NextSyncToken = tt.changes, "incremental"
+				} else {
+					mu.Lock()
+					queries = append(queries, "full")
+					mu.Unlock()
+					if q.Get("timeMin") != window.apiMin() || q.Get("timeMax") != window.apiMax() {
+						t.Errorf("full sync of %s to %s, want %s", q.Get("timeMin"), q.Get("timeMax"), window)
+					}
+					list.Items, list.NextSyncToken = tt.full, "full"
+				}
+				json.NewEncoder(w).Encode(list)
+			}))
+
+			got, err := syncEvents(context.Background(), srv, acct, "me@x.com", window, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(queries, tt.wantQueries) {
+				t.Errorf("queries %q, want %q", queries, tt.wantQueries)
+			}
+			var events, deleted []string
+			for id := range got.Events {
+				events = append(events, id)
+			}
+			for uid := range got.Deleted {
+				deleted = append(deleted, uid)
+			}
+			sort.Strings(events)
+			sort.Strings(deleted)
+			if !reflect.DeepEqual(events, tt.wantEvents) {
+				t.Errorf("events %q, want %q", events, tt.wantEvents)
+			}
+			if !reflect.DeepEqual(deleted, tt.wantDeleted) {
+				t.Errorf("deleted %q, want %q", deleted, tt.wantDeleted)
+			}
+			if got.SyncToken != tt.wantToken {
+				t.Errorf("sync token %q, want %q", got.SyncToken, tt.wantToken)
+			}
+
+			// What was returned is what the next run starts from.
+			saved := loadEventCache(path, "me@x.com")
+			if saved.SyncToken != got.SyncToken || len(saved.Events) != len(got.Events) ||
+				len(saved.Deleted) != len(got.Deleted) {
+				t.Errorf("saved cache has token %q, %d events, %d deletions, want %q, %d, %d",
+					saved.SyncToken, len(saved.Events), len(saved.Deleted),
+					got.SyncToken, len(got.Events), len(got.Deleted))
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/calendar/v3"
+)
+
+var calendarsCmd = &command{
+	name:  "calendars",
+	args:  "[flags]",
+	short: "list the calendars an account can see",
+	long: `
+Calendars lists every calendar of the configured accounts, including hidden
+ones, so you can find the ids to put in the config file.
+`,
+	run: runCalendars,
+}
+
+// listCalendars returns every calendar list entry of the account, following
+// page tokens.
+func listCalendars(ctx context.Context, srv *calendar.Service, showHidden bool) ([]*calendar.CalendarListEntry, error) {
+	var entries []*calendar.CalendarListEntry
+	npt := ""
+	for {
+		req := srv.CalendarList.List().ShowHidden(showHidden).ShowDeleted(false).
+			MaxResults(250)
+		if npt != "" {
+			req = req.PageToken(npt)
+		}
+		list, err := req.Context(ctx).Do()
+		if err != nil {
+			return nil, apiError(fmt.Errorf("unable to list calendars: %w", err))
+		}
+		entries = append(entries, list.Items...)
+		if list.NextPageToken == "" {
+			return entries, nil
+		}
+		npt = list.NextPageToken
+	}
+}
+
+// calendarInfo is the part of a calendar list entry we show.
+type calendarInfo struct {
+	Account    string `json:"account"`
+	ID         string `json:"id"`
+	Summary    string `json:"summary"`
+	Primary    bool   `json:"primary"`
+	AccessRole string `json:"accessRole"`
+	TimeZone   string `json:"timeZone"`
+	ColorID    string `json:"colorId"`
+	Hidden     bool   `json:"hidden"`
+	Selected   bool   `json:"selected"`
+}
+
+func runCalendars(cmd *command, args []string) error {
+	fs := cmd.flags()
+	configPath := configFlag(fs)
+	accounts := fs.String("account", "", "comma separated accounts to list (default all)")
+	format := fs.String("format", "table", "output format: table, json or org")
+	if err := cmd.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usageError(fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " ")))
+	}
+	var printer func(io.Writer, []calendarInfo) error
+	switch *format {
+	case "table":
+		printer = printCalendarTable
+	case "json":
+		printer = printCalendarJSON
+	case "org":
+		printer = printCalendarOrg
+	default:
+		return usageError(fmt.Errorf("unknown format %q", *format))
+	}
+
+	conf, err := loadConfig(*configPath)
+	if err != nil {
+		return configError(err)
+	}
+	accts, err := conf.selectAccounts(*accounts)
+	if err != nil {
+		return configError(err)
+	}
+
+	infos := make([]calendarInfo, 0)
+	for _, acct := range accts {
+		cl, err := genClient(acct, calendar.CalendarReadonlyScope)
+		if err != nil {
+			return fmt.Errorf("%s: %w", acct.Name, err)
+		}
+		srv, err := calendar.New(cl)
+		if err != nil {
+			return apiError(fmt.Errorf("%s: unable to create calendar client: %w", acct.Name, err))
+		}
+		entries, err := listCalendars(context.Background(), srv, true)
+		if err != nil {
+			return fmt.Errorf("%s: %w", acct.Name, err)
+		}
+		for _, c := range entries {
+			infos = append(infos, calendarInfo{
+				Account:    acct.Name,
+				ID:         c.Id,
+				Summary:    c.Summary,
+				Primary:    c.Primary,
+				AccessRole: c.AccessRole,
+				TimeZone:   c.TimeZone,
+				ColorID:    c.ColorId,
+				Hidden:     c.Hidden,
+				Selected:   c.Selected,
+			})
+		}
+	}
+
+	return printer(os.Stdout, infos)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func printCalendarTable(w io.Writer, infos []calendarInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "ACCOUNT\tID\tSUMMARY\tPRIMARY\tROLE\tTIMEZONE\tCOLOR\tHIDDEN\tSELECTED\n")
+	for _, c := range infos {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			c.Account, c.ID, c.Summary, yesNo(c.Primary), c.AccessRole,
+			c.TimeZone, c.ColorID, yesNo(c.Hidden), yesNo(c.Selected))
+	}
+	return tw.Flush()
+}
+
+func printCalendarJSON(w io.Writer, infos []calendarInfo) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(infos)
+}
+
+func printCalendarOrg(w io.Writer, infos []calendarInfo) error {
+	account := ""
+	for _, c := range infos {
+		if c.Account != account {
+			account = c.Account
+			fmt.Fprintf(w, "* %s\n", account)
+		}
+		attrs := []string{c.AccessRole, c.TimeZone}
+		if c.ColorID != "" {
+			attrs = append(attrs, "color "+c.ColorID)
+		}
+		if c.Primary {
+			attrs = append(attrs, "primary")
+		}
+		if c.Hidden {
+			attrs = append(attrs, "hidden")
+		}
+		if c.Selected {
+			attrs = append(attrs, "selected")
+		}
+		fmt.Fprintf(w, "- %s :: =%s= (%s)\n", cleanString(noTodoKwds(c.Summary)), c.ID,
+			strings.Join(attrs, ", "))
+	}
+	return nil
+}
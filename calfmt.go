@@ -9,6 +9,37 @@ import (
 	"google.golang.org/api/calendar/v3"
 )
 
+// eventTime returns the time of dt, all day dates being midnight local
+// time. It is the zero time if dt is unset or doesn't parse.
+func eventTime(dt *calendar.EventDateTime) time.Time {
+	if dt == nil {
+		return time.Time{}
+	}
+	if dt.Date != "" {
+		t, _ := time.ParseInLocation("2006-01-02", dt.Date, time.Local)
+		return t
+	}
+	t, _ := time.Parse(time.RFC3339, dt.DateTime)
+	return t
+}
+
+// eventStart returns when e starts, or would have for a cancelled
+// occurrence.
+func eventStart(e *calendar.Event) time.Time {
+	if e.Start == nil {
+		return eventTime(e.OriginalStartTime)
+	}
+	return eventTime(e.Start)
+}
+
+// eventEnd returns when e ends, or when it starts if it has no end.
+func eventEnd(e *calendar.Event) time.Time {
+	if t := eventTime(e.End); !t.IsZero() {
+		return t
+	}
+	return eventStart(e)
+}
+
 func datesToOrg(start, end *calendar.EventDateTime) string {
 	final := ""
 	if start == nil { // this event has dates! hurrah!
@@ -96,38 +127,59 @@ func isDeclinedByMe(e *calendar.Event) bool {
 	return false
 }
 
-func fmtOrgHeader(e *calendar.Event) string {
-	var buf string
-	buf += fmt.Sprintf("** ")
-	if e.Status == "tenative" || e.Status == "cancelled" {
-		buf += fmt.Sprintf("(%s) ", e.Status)
-	}
-	summary := e.Summary
-	if summary == "" {
-		summary = "busy"
+func fmtOrgDate(e *calendar.Event) string {
+	return fmtDates(e, datesToOrg)
+}
+
+func fmtInactiveOrgDate(e *calendar.Event) string {
+	return fmtDates(e, datesToInactiveOrg)
+}
+
+// fmtDates formats the timestamps of e with dates. A recurring event gets a
+// repeating timestamp per repeater, followed by its removed occurrences, and
+// a cancelled occurrence gets an inactive timestamp saying so.
+func fmtDates(e *calendar.Event, dates func(start, end *calendar.EventDateTime) string) string {
+	if isCancelledOccurrence(e) {
+		return fmt.Sprintf("%s cancelled\n", datesToInactiveOrg(e.OriginalStartTime, nil))
 	}
 
-	buf += fmt.Sprintf("%s\n", noTodoKwds(summary))
-	buf += fmt.Sprintf(":PROPERTIES:\n")
-	buf += fmt.Sprintf(":ID:       %s\n", e.ICalUID)
-	buf += fmt.Sprintf(":GCALLINK: %s\n", e.HtmlLink)
-	if e.Creator != nil {
-		buf += fmt.Sprintf(":CREATOR: [[mailto:%s][%s]]\n", e.Creator.Email, cleanString(e.Creator.DisplayName))
+	rec, ok := parseRecurrence(e)
+	if !ok {
+		return fmt.Sprintf("%s\n", dates(e.Start, e.End))
 	}
-	if e.Organizer != nil {
-		buf += fmt.Sprintf(":ORGANIZER: [[mailto:%s][%s]]\n", e.Organizer.Email, cleanString(e.Organizer.DisplayName))
+	var buf string
+	for _, offset := range rec.offsets {
+		date := dates(shiftDate(e.Start, offset), shiftDate(e.End, offset))
+		buf += fmt.Sprintf("%s\n", withRepeater(date, rec.cookie()))
+	}
+	for _, ex := range rec.exdates {
+		buf += fmt.Sprintf("%s cancelled\n", datesToInactiveOrg(ex, nil))
 	}
-	buf += fmt.Sprintf(":END:\n\n")
-
 	return buf
 }
 
-func fmtOrgDate(e *calendar.Event) string {
-	return fmt.Sprintf("%s\n", datesToOrg(e.Start, e.End))
+// isCancelledOccurrence reports whether e is a removed occurrence of a
+// recurring event, which has nothing but its original start.
+func isCancelledOccurrence(e *calendar.Event) bool {
+	return e.Status == "cancelled" && e.RecurringEventId != ""
 }
 
-func fmtInactiveOrgDate(e *calendar.Event) string {
-	return fmt.Sprintf("%s\n", datesToInactiveOrg(e.Start, e.End))
+// groupHead returns the event whose summary and details stand for the
+// group: the last recurring master, which describes the whole series, or
+// else the last event that isn't a cancelled occurrence, as it has the most
+// recent info. It is nil if every event in the group was cancelled.
+func groupHead(events []*calendar.Event) *calendar.Event {
+	for i := len(events) - 1; i >= 0; i-- {
+		if len(events[i].Recurrence) > 0 {
+			return events[i]
+		}
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		if !isCancelledOccurrence(events[i]) {
+			return events[i]
+		}
+	}
+	return nil
 }
 
 func fmtOrgAttendees(e *calendar.Event) string {
@@ -178,7 +230,7 @@ func fmtOrgAttendees(e *calendar.Event) string {
 		case "NeedsAction":
 		case "declined":
 			statuschar = "✗"
-		case "tenative":
+		case "tentative":
 			statuschar = "☐"
 		case "accepted":
 			statuschar = "✓"
@@ -216,42 +268,8 @@ func fmtOrgBody(e *calendar.Event) string {
 	return buf
 }
 
-func fmtEventGroup(calid string, events []*calendar.Event) string {
-	var buf string
-
-	// take the last header of the set, has the most recent summary info.
-	buf = fmtOrgHeader(events[len(events)-1])
-
-	// Put the dates from each event repeat
-	unique_attendees := make(map[string]struct{})
-	for _, i := range events {
-		if attendingEvent(calid, *i) {
-			buf += fmtOrgDate(i)
-		} else {
-			buf += fmtInactiveOrgDate(i)
-		}
-		attendee := fmtOrgAttendees(i)
-		if _, ok := unique_attendees[attendee]; !ok {
-			unique_attendees[attendee] = struct{}{}
-			buf += attendee
-		}
-	}
-
-	unique_bodies := make(map[string]struct{})
-	// Remove duplicate bodies
-	for _, i := range events {
-		body := fmtOrgBody(i)
-		if _, ok := unique_bodies[body]; !ok {
-			unique_bodies[body] = struct{}{}
-			buf += body
-		}
-	}
-
-	return buf
-}
-
-func filteredEvent(calid, summary string) bool {
-	for _, title := range titleFilters[calid] {
+func filteredEvent(cal *calendarConfig, summary string) bool {
+	for _, title := range cal.TitleFilters {
 		if strings.Contains(summary, title) {
 			return true
 		}
@@ -260,8 +278,8 @@ func filteredEvent(calid, summary string) bool {
 	return false
 }
 
-func attendingEvent(calid string, event calendar.Event) bool {
-	for _, email := range attendeeFilters[calid] {
+func attendingEvent(cal *calendarConfig, event calendar.Event) bool {
+	for _, email := range cal.AttendeeFilters {
 		for _, att := range event.Attendees {
 			if (att.Email == email ||
 				att.Id == email ||
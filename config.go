@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// config is the runtime configuration. It replaces the calendar lists and
+// filters that used to be compiled in, so one binary can serve everyone.
+type config struct {
+	// From and To bound the exported events, see parseTimeSpec.
+	From string `toml:"from"`
+	To   string `toml:"to"`
+
+	// FailFast makes export stop at the first failing calendar or account
+	// instead of writing an ERROR heading for it.
+	FailFast bool `toml:"fail_fast"`
+
+	// Concurrency is how many calendars export fetches at once.
+	Concurrency int `toml:"concurrency"`
+
+	// Order and Group arrange the event headings, see eventOrders and
+	// eventGroupings.
+	Order string `toml:"order"`
+	Group string `toml:"group"`
+
+	// Layout is the layout of the file, see fileLayouts.
+	Layout string `toml:"layout"`
+
+	Tokens    tokenConfig    `toml:"tokens"`
+	Retry     retryConfig    `toml:"retry"`
+	Templates templateConfig `toml:"templates"`
+
+	Accounts []*account `toml:"account"`
+
+	// path is the file the config was read from.
+	path string
+
+	// templates are the parsed Templates.
+	templates *orgTemplates
+}
+
+// account is one google login, with the client secret used to authorize it
+// and the calendars we export from it.
+type account struct {
+	Name string `toml:"name"`
+
+	// Label and Email describe the account in 'gcalorg accounts list'.
+	Label string `toml:"label"`
+	Email string `toml:"email"`
+
+	// Type is "oauth" (the default), authorizing a user with the installed
+	// app client in Secret, or "service_account", using the service account
+	// key in Key, impersonating Subject if set.
+	Type    string `toml:"type"`
+	Secret  string `toml:"secret"`
+	Key     string `toml:"key"`
+	Subject string `toml:"subject"`
+
+	Tag string `toml:"tag"`
+
+	// From and To override the global export window for the account's
+	// calendars.
+	From string `toml:"from"`
+	To   string `toml:"to"`
+
+	Calendars []*calendarConfig `toml:"calendar"`
+
+	// tokens is where the account's oauth tokens are kept.
+	tokens tokenStore
+
+	// retry is how the account's API calls are retried.
+	retry retryPolicy
+}
+
+// Account types.
+const (
+	oauthAccount   = "oauth"
+	serviceAccount = "service_account"
+)
+
+// calendarConfig is a calendar to export, and the filters applied to its
+// events.
+type calendarConfig struct {
+	ID  string `toml:"id"`
+	Tag string `toml:"tag"`
+
+	// From and To override the account's export window for this calendar.
+	From string `toml:"from"`
+	To   string `toml:"to"`
+
+	// TitleFilters drops events whose summary contains any of these.
+	TitleFilters []string `toml:"title_filters"`
+
+	// AttendeeFilters lists the attendee ids, emails or display names
+	// that are "me", so events I've declined are shown as inactive.
+	AttendeeFilters []string `toml:"attendee_filters"`
+}
+
+// tag returns the org tag for the calendar's top level heading, falling back
+// to the account's tag.
+func (c *calendarConfig) tag(a *account) string {
+	if c.Tag != "" {
+		return c.Tag
+	}
+	return a.Tag
+}
+
+// xdgDir returns the XDG base directory named by env, or fallback under the
+// home directory when it isn't set.
+func xdgDir(env, fallback string) (string, error) {
+	if dir := os.Getenv(env); dir != "" && filepath.IsAbs(dir) {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, fallback), nil
+}
+
+// defaultConfigPath returns $XDG_CONFIG_HOME/gcalorg/config.toml.
+func defaultConfigPath() (string, error) {
+	dir, err := xdgDir("XDG_CONFIG_HOME", ".config")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gcalorg", "config.toml"), nil
+}
+
+// expandPath expands a leading ~/ and makes relative paths relative to the
+// directory the config file lives in.
+func expandPath(p, base string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			p = filepath.Join(home, p[1:])
+		}
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(base, p)
+	}
+	return p
+}
+
+// loadConfig reads and validates the config file at path. An empty path means
+// the default location.
+func loadConfig(path string) (*config, error) {
+	conf, err := decodeConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := conf.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", conf.path, err)
+	}
+	return conf, nil
+}
+
+// decodeConfig reads the config file at path without validating it.
+func decodeConfig(path string) (*config, error) {
+	if path == "" {
+		var err error
+		if path, err = defaultConfigPath(); err != nil {
+			return nil, err
+		}
+	}
+
+	conf := &config{path: path}
+	md, err := toml.DecodeFile(path, conf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("%s: unknown key %q", path, undecoded[0].String())
+	}
+	return conf, nil
+}
+
+func (c *config) validate() error {
+	if len(c.Accounts) == 0 {
+		return fmt.Errorf("no accounts configured")
+	}
+
+	base := filepath.Dir(c.path)
+	tokens, err := c.Tokens.store(base)
+	if err != nil {
+		return err
+	}
+	retry, err := c.Retry.policy(time.Now())
+	if err != nil {
+		return err
+	}
+	if c.templates, err = c.Templates.templates(base); err != nil {
+		return err
+	}
+	if c.Concurrency < 0 {
+		return fmt.Errorf("concurrency can't be negative")
+	}
+	if c.Order != "" {
+		if err := checkChoice("order", c.Order, eventOrders); err != nil {
+			return err
+		}
+	}
+	if c.Group != "" {
+		if err := checkChoice("group", c.Group, eventGroupings); err != nil {
+			return err
+		}
+	}
+	if c.Layout != "" {
+		if err := checkChoice("layout", c.Layout, fileLayouts); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]struct{})
+	for i, a := range c.Accounts {
+		if a.Name == "" {
+			return fmt.Errorf("account #%d has no name", i+1)
+		}
+		if _, ok := names[a.Name]; ok {
+			return fmt.Errorf("account %q is defined twice", a.Name)
+		}
+		names[a.Name] = struct{}{}
+		a.tokens = tokens
+		a.retry = retry
+
+		switch a.Type {
+		case "", oauthAccount:
+			a.Type = oauthAccount
+			if a.Secret == "" {
+				return fmt.Errorf("account %q has no secret", a.Name)
+			}
+			if a.Key != "" || a.Subject != "" {
+				return fmt.Errorf("account %q: key and subject are for service accounts", a.Name)
+			}
+			a.Secret = expandPath(a.Secret, base)
+		case serviceAccount:
+			if a.Key == "" {
+				return fmt.Errorf("account %q has no key", a.Name)
+			}
+			if a.Secret != "" {
+				return fmt.Errorf("account %q: service accounts take a key, not a secret", a.Name)
+			}
+			a.Key = expandPath(a.Key, base)
+		default:
+			return fmt.Errorf("account %q: unknown type %q, want %q or %q",
+				a.Name, a.Type, oauthAccount, serviceAccount)
+		}
+
+		for j, cal := range a.Calendars {
+			if cal.ID == "" {
+				return fmt.Errorf("account %q: calendar #%d has no id", a.Name, j+1)
+			}
+			if _, err := c.window(a, cal, "", "", time.Now()); err != nil {
+				return fmt.Errorf("account %q: %v", a.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// defaultConcurrency is how many calendars are fetched at once unless the
+// config says otherwise.
+const defaultConcurrency = 4
+
+// concurrency returns how many calendars to fetch at once.
+func (c *config) concurrency() int {
+	if c.Concurrency > 0 {
+		return c.Concurrency
+	}
+	return defaultConcurrency
+}
+
+// order returns how event headings are ordered.
+func (c *config) order() string {
+	if c.Order != "" {
+		return c.Order
+	}
+	return orderStart
+}
+
+// group returns how event headings are grouped.
+func (c *config) group() string {
+	if c.Group != "" {
+		return c.Group
+	}
+	return groupCalendar
+}
+
+// layout returns the layout of the exported file.
+func (c *config) layout() string {
+	if c.Layout != "" {
+		return c.Layout
+	}
+	return layoutOutline
+}
+
+// account returns the configured account called name.
+func (c *config) account(name string) (*account, error) {
+	for _, a := range c.Accounts {
+		if a.Name == name {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("no account named %q in %s", name, c.path)
+}
+
+// selectAccounts returns the accounts named in the comma separated list
+// names, in config order, or every account if names is empty.
+func (c *config) selectAccounts(names string) ([]*account, error) {
+	if names == "" {
+		return c.Accounts, nil
+	}
+	want := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if _, err := c.account(name); err != nil {
+			return nil, err
+		}
+		want[name] = true
+	}
+	var accts []*account
+	for _, a := range c.Accounts {
+		if want[a.Name] {
+			accts = append(accts, a)
+		}
+	}
+	return accts, nil
+}
@@ -1,39 +0,0 @@
-package main
-
-// This is a file so I can remember how these arrays are. I should really make
-// these distinct data structures, but done + messy is better than not done.
-
-// These are the list of calendars I use to sync from my personal google
-// calendar.
-
-// var gmailCals = []string{
-// 	"mycalendar@gmail.com",                      // work
-// 	"randomstring@import.calendar.google.com",   // fbcal
-// 	"sharedpersonal@import.calendar.google.com", //lover
-// }
-
-// These are the list of calendars I use to sync from my work's google calendar.
-//
-//
-
-// var workCals = []string{
-// 	"jmickey@workplace.com",
-// }
-
-// These are repeating events that I describe in my org file
-//
-// var titleFilters = map[string][]string{
-// 	"jmickey@workplace.com": []string{
-// 		"Standup",
-// 		"Status Report",
-// 	},
-// }
-
-// This is a map of calendar id to attendee id so we don't show calendar events
-// I've said no to.
-//
-// var attendeeFilters = map[string][]string{
-// 	"jmickey@workplace.com": []string{
-// 		"jmickey@workplace.com",
-// 	},
-// }
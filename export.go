@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/calendar/v3"
+)
+
+var exportCmd = &command{
+	name:  "export",
+	args:  "[flags]",
+	short: "write the configured calendars as an org file",
+	long: `
+Export fetches the events of every configured calendar and writes them to
+stdout, or the file given with --output, as an org-mode file. A calendar or
+account that fails is reported on stderr and written as an ERROR heading,
+and the rest is exported anyway. With --fail-fast (or fail_fast in the
+config) the first failure stops the export instead, nothing is written and
+gcalorg exits non-zero.
+
+Events are cached under $XDG_CACHE_HOME/gcalorg, and later runs only fetch
+what changed since the last one. A different window, an expired sync token
+or --full fetches everything again.
+
+--output replaces the file in one step once the export is done, so Emacs
+reverting it never sees a partial file and a failed run leaves the old one
+in place. The file isn't touched when nothing changed, and a lock next to it
+(path.lock) makes an export that overlaps a running one fail.
+
+With --merge the file isn't written from scratch: event headings are matched
+up with the ones in the file by their :ID:, and only the parts gcalorg owns
+are regenerated, the heading title, its properties and the :GCALLINES: lines
+of text after them. Todo keywords, priorities, tags, properties, planning
+lines, LOGBOOK drawers, notes written after the generated text and
+subheadings are kept. Events that were deleted in google calendar are kept
+with an ARCHIVE tag and :GCALGONE:, and other events that are no longer
+exported, like ones that left the window, are kept as they are. So are the
+headings of a calendar that fails. Headings written before there was
+:GCALLINES: keep their whole text as notes.
+
+Event headings go under a heading per calendar, ordered by when they first
+start. --order sorts them by their next upcoming start instead (finished
+events last), by when they were last changed, by title or by id. --group day
+or week puts them under a heading per day or ISO week instead, across all
+calendars, and merged lists them all without headings above them. Without
+their calendar's heading, event headings get its tag and a :CALENDAR:
+property.
+
+--layout datetree files them under year, month and day headings instead,
+like an org-capture datetree, for journal style files. Events go on the day
+they start, or next start with --order next, and --group doesn't apply.
+
+When an account can't be fetched (no network, expired token) it is rendered
+from the snapshot of its last successful fetch instead, and the file header
+says how old that snapshot is. --offline always does this.
+`,
+	run: runExport,
+}
+
+func runExport(cmd *command, args []string) error {
+	fs := cmd.flags()
+	configPath := configFlag(fs)
+	accounts := fs.String("account", "", "comma separated accounts to export (default all)")
+	from := fs.String("from", "", "start of the export window, e.g. 2026-01-01, -2w or today "+
+		"(default "+defaultFrom+")")
+	to := fs.String("to", "", "end of the export window, e.g. +90d (default "+defaultTo+")")
+	full := fs.Bool("full", false, "ignore the event cache and fetch the whole window again")
+	offline := fs.Bool("offline", false, "render from the last snapshot without contacting google")
+	failFast := fs.Bool("fail-fast", false, "stop at the first failing calendar or account")
+	output := fs.String("output", "", "write to this file, replacing it atomically, instead of stdout")
+	merge := fs.Bool("merge", false, "keep notes, todo states, tags and subheadings added to "+
+		"the --output file")
+	order := fs.String("order", "", "order of the event headings: "+strings.Join(eventOrders, ", ")+
+		" (default order from the config, or start)")
+	fileLayout := fs.String("layout", "", "file layout: "+strings.Join(fileLayouts, ", ")+
+		" (default layout from the config, or outline)")
+	group := fs.String("group", "", "group event headings by "+strings.Join(eventGroupings, ", ")+
+		" (default group from the config, or calendar)")
+	jobs := fs.Int("jobs", 0, "how many calendars to fetch at once "+
+		"(default concurrency from the config, or 4)")
+	if err := cmd.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usageError(fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " ")))
+	}
+
+	conf, err := loadConfig(*configPath)
+	if err != nil {
+		return configError(err)
+	}
+	accts, err := conf.selectAccounts(*accounts)
+	if err != nil {
+		return configError(err)
+	}
+	now := time.Now()
+	for _, s := range []string{*from, *to} {
+		if s == "" {
+			continue
+		}
+		if _, err := parseTimeSpec(s, now); err != nil {
+			return usageError(err)
+		}
+	}
+	windowFor := func(acct *account, cal *calendarConfig) (timeWindow, error) {
+		return conf.window(acct, cal, *from, *to, now)
+	}
+	*failFast = *failFast || conf.FailFast
+	if *jobs < 0 {
+		return usageError(fmt.Errorf("--jobs can't be negative"))
+	}
+	if *jobs == 0 {
+		*jobs = conf.concurrency()
+	}
+	if *order == "" {
+		*order = conf.order()
+	} else if err := checkChoice("order", *order, eventOrders); err != nil {
+		return usageError(err)
+	}
+	if *group == "" {
+		*group = conf.group()
+	} else if err := checkChoice("group", *group, eventGroupings); err != nil {
+		return usageError(err)
+	}
+	if *fileLayout == "" {
+		*fileLayout = conf.layout()
+	} else if err := checkChoice("layout", *fileLayout, fileLayouts); err != nil {
+		return usageError(err)
+	}
+	if *fileLayout == layoutDatetree {
+		*group = groupDatetree
+	}
+	if *merge && *output == "" {
+		return usageError(fmt.Errorf("--merge needs --output"))
+	}
+
+	if *output != "" {
+		unlock, err := lockOutput(*output)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	f := &fetcher{ctx: ctx, pool: newWorkPool(*jobs), windowFor: windowFor, full: *full}
+	if *failFast {
+		f.failed = func(error) { cancel() }
+	}
+
+	// Authorizing may need the user, so it's done one account at a time
+	// before fetching everything at once.
+	clients := make([]*calendar.Service, len(accts))
+	clientErrs := make([]error, len(accts))
+	if !*offline {
+		for i, acct := range accts {
+			clients[i], clientErrs[i] = accountService(acct)
+			if clientErrs[i] != nil && *failFast {
+				return fmt.Errorf("%s: %w", acct.Name, clientErrs[i])
+			}
+		}
+	}
+
+	results := make([]*accountData, len(accts))
+	var wg sync.WaitGroup
+	for i, acct := range accts {
+		wg.Add(1)
+		go func(i int, acct *account) {
+			defer wg.Done()
+			var data *accountData
+			var err error
+			if *offline {
+				data, err = f.snapshot(acct)
+			} else {
+				data, err = f.fetchOrSnapshot(acct, clients[i], clientErrs[i])
+			}
+			if err != nil {
+				f.fail(err)
+				data = &accountData{acct: acct, err: err}
+			}
+			results[i] = data
+		}(i, acct)
+	}
+	wg.Wait()
+	if *failFast {
+		if err := firstFailure(results); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	var notes []string
+	for _, data := range results {
+		if !data.snapshot.IsZero() {
+			notes = append(notes, fmt.Sprintf("%s rendered offline from a snapshot taken %s (%s ago)",
+				data.acct.Name, data.snapshot.Format("2006-01-02 Mon 15:04"),
+				fmtAge(time.Since(data.snapshot))))
+		}
+	}
+	l := layout{order: *order, group: *group, now: now, tmpl: conf.templates}
+	if err := l.printEvents(&body, results); err != nil {
+		return configError(fmt.Errorf("template: %w", err))
+	}
+
+	var buf bytes.Buffer
+	if err := conf.templates.writeHeader(&buf, notes); err != nil {
+		return configError(fmt.Errorf("template: %w", err))
+	}
+	body.WriteTo(&buf)
+
+	if *output != "" {
+		data := buf.Bytes()
+		if *merge {
+			if data, err = mergeOutput(*output, data, exportedCalendars(results)); err != nil {
+				return err
+			}
+		}
+		return writeOutput(*output, data)
+	}
+	_, err = buf.WriteTo(os.Stdout)
+	return err
+}
+
+// lockOutput locks the output file path against other exports and pushes,
+// so two runs that overlap don't write it at the same time.
+func lockOutput(path string) (unlock func(), err error) {
+	unlock, ok, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("unable to lock %s: %w", path, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("another gcalorg export or push is writing %s", path)
+	}
+	return unlock, nil
+}
+
+// writeOutput replaces the file at path with data, atomically so an editor
+// reverting the file never sees half of it. The file is left alone if it
+// already holds data.
+func writeOutput(path string, data []byte) error {
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+		if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, data) {
+			fmt.Fprintf(os.Stderr, "%s is up to date\n", path)
+			return nil
+		}
+	}
+	if err := writeFileAtomic(path, data, perm); err != nil {
+		return fmt.Errorf("unable to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// fmtAge formats d to the minute, without the trailing "0s".
+func fmtAge(d time.Duration) string {
+	if d < time.Minute {
+		return "less than a minute"
+	}
+	return strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+}
+
+// accountData is everything needed to render an account.
+type accountData struct {
+	acct      *account
+	calendars []*calendarData
+
+	// snapshot is when the data was fetched, if it came from the cache
+	// rather than the API.
+	snapshot time.Time
+
+	// err is why the account couldn't be fetched, not even from a snapshot.
+	err error
+}
+
+// calendarData is a configured calendar with its events, or the reason we
+// don't have them.
+type calendarData struct {
+	conf   *calendarConfig
+	entry  *calendar.CalendarListEntry
+	events []*calendar.Event
+	err    error
+
+	// deleted are the events the cache saw deleted, see eventCache.
+	deleted map[string]time.Time
+}
+
+// exportedCalendars returns the configured calendars of results by id, for
+// merging.
+func exportedCalendars(results []*accountData) map[string]exportedCalendar {
+	cals := make(map[string]exportedCalendar)
+	for _, data := range results {
+		for _, cal := range data.acct.Calendars {
+			if _, ok := cals[cal.ID]; !ok {
+				cals[cal.ID] = exportedCalendar{tag: cal.tag(data.acct)}
+			}
+		}
+		if data.err != nil {
+			continue
+		}
+		for _, cd := range data.calendars {
+			if cd.err == nil {
+				cals[cd.conf.ID] = exportedCalendar{
+					tag:     cd.conf.tag(data.acct),
+					fetched: true,
+					deleted: cd.deleted,
+				}
+			}
+		}
+	}
+	return cals
+}
+
+// firstError returns the first failure in data, naming the account and
+// calendar.
+func (data *accountData) firstError() error {
+	if data.err != nil {
+		return fmt.Errorf("%s: %w", data.acct.Name, data.err)
+	}
+	for _, cd := range data.calendars {
+		if cd.err != nil {
+			return fmt.Errorf("%s: %s: %w", data.acct.Name, cd.conf.ID, cd.err)
+		}
+	}
+	return nil
+}
+
+// firstFailure returns the first failure in results, in config order,
+// skipping the ones that only failed because fail fast cancelled them.
+func firstFailure(results []*accountData) error {
+	var cancelled error
+	for _, data := range results {
+		err := data.firstError()
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, context.Canceled) {
+			return err
+		}
+		if cancelled == nil {
+			cancelled = err
+		}
+	}
+	return cancelled
+}
+
+// accountService returns a calendar API client for acct.
+func accountService(acct *account) (*calendar.Service, error) {
+	fmt.Fprintf(os.Stderr, "Getting client for: %s\n", acct.Name)
+	client, err := genClient(acct, calendar.CalendarReadonlyScope)
+	if err != nil {
+		return nil, err
+	}
+	srv, err := calendar.New(client)
+	if err != nil {
+		return nil, apiError(fmt.Errorf("unable to create calendar client: %w", err))
+	}
+	return srv, nil
+}
+
+// workPool bounds how many API calls run at once.
+type workPool struct {
+	slots chan struct{}
+}
+
+func newWorkPool(n int) *workPool {
+	return &workPool{slots: make(chan struct{}, n)}
+}
+
+// do runs fn once a slot is free, unless ctx is done first.
+func (p *workPool) do(ctx context.Context, fn func() error) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.slots }()
+	return fn()
+}
+
+// fetcher fetches the accounts of an export, all sharing one pool.
+type fetcher struct {
+	ctx       context.Context
+	pool      *workPool
+	windowFor func(*account, *calendarConfig) (timeWindow, error)
+	full      bool
+
+	// failed, if set, is called with every failure.
+	failed func(error)
+}
+
+func (f *fetcher) fail(err error) {
+	if f.failed != nil {
+		f.failed(err)
+	}
+}
+
+// fetchOrSnapshot fetches acct with srv, falling back to its last snapshot
+// when that fails. srvErr is why there is no srv.
+func (f *fetcher) fetchOrSnapshot(acct *account, srv *calendar.Service, srvErr error) (*accountData, error) {
+	err := srvErr
+	if err == nil {
+		var data *accountData
+		if data, err = f.fetch(acct, srv); err == nil {
+			return data, nil
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s: %v\n", acct.Name, err)
+	if f.ctx.Err() != nil {
+		return nil, err
+	}
+	data, serr := loadAccountSnapshot(acct, f.windowFor)
+	if serr != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "%s: falling back to the snapshot from %s\n", acct.Name,
+		data.snapshot.Format(time.RFC3339))
+	return data, nil
+}
+
+// snapshot loads the last snapshot of acct.
+func (f *fetcher) snapshot(acct *account) (*accountData, error) {
+	data, err := loadAccountSnapshot(acct, f.windowFor)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", acct.Name, err)
+	}
+	return data, err
+}
+
+// fetch syncs the configured calendars of acct with the API, each calendar
+// as a job of its own.
+func (f *fetcher) fetch(acct *account, srv *calendar.Service) (*accountData, error) {
+	var calendars []*calendar.CalendarListEntry
+	err := f.pool.do(f.ctx, func() error {
+		var err error
+		calendars, err = listCalendars(f.ctx, srv, false)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := saveCalendarList(acct, calendars); err != nil {
+		return nil, fmt.Errorf("unable to save calendar list: %w", err)
+	}
+
+	data := &accountData{acct: acct, calendars: approvedCalendars(acct, calendars)}
+	for _, cd := range data.calendars {
+		if cd.err != nil {
+			f.fail(cd.err)
+		}
+	}
+	windows := make([]timeWindow, len(data.calendars))
+	for i, cd := range data.calendars {
+		if windows[i], err = f.windowFor(acct, cd.conf); err != nil {
+			return nil, usageError(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i, cd := range data.calendars {
+		if cd.err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(cd *calendarData, window timeWindow) {
+			defer wg.Done()
+			err := f.pool.do(f.ctx, func() error {
+				cache, err := syncEvents(f.ctx, srv, acct, cd.entry.Id, window, f.full)
+				if err != nil {
+					return err
+				}
+				cd.events, cd.deleted = cache.events(window), cache.Deleted
+				return nil
+			})
+			if err != nil {
+				// The other calendars may still work.
+				cd.err = err
+				fmt.Fprintf(os.Stderr, "%s: %s: %v\n", acct.Name, cd.conf.ID, err)
+				f.fail(err)
+			}
+		}(cd, windows[i])
+	}
+	wg.Wait()
+	return data, nil
+}
+
+// loadAccountSnapshot returns what the last successful fetch of acct saw.
+func loadAccountSnapshot(acct *account, windowFor func(*account, *calendarConfig) (timeWindow, error)) (*accountData, error) {
+	list, err := loadCalendarList(acct)
+	if err != nil {
+		return nil, fmt.Errorf("no snapshot to fall back to: %w", err)
+	}
+
+	data := &accountData{acct: acct, snapshot: list.Fetched}
+	for _, cd := range approvedCalendars(acct, list.Calendars) {
+		data.calendars = append(data.calendars, cd)
+		if cd.err != nil {
+			continue
+		}
+		window, err := windowFor(acct, cd.conf)
+		if err != nil {
+			return nil, usageError(err)
+		}
+		path, err := eventCachePath(acct, cd.entry.Id)
+		if err != nil {
+			return nil, err
+		}
+		cache := loadEventCache(path, cd.entry.Id)
+		if cache.Synced.IsZero() {
+			fmt.Fprintf(os.Stderr, "%s: no cached events for %s\n", acct.Name, cd.entry.Id)
+		} else if cache.Synced.Before(data.snapshot) {
+			data.snapshot = cache.Synced
+		}
+		cd.events, cd.deleted = cache.events(window), cache.Deleted
+	}
+	return data, nil
+}
+
+// approvedCalendars matches the configured calendars of acct up with the
+// calendar list, in config order. Calendars missing from the list come with
+// an error.
+func approvedCalendars(acct *account, calendars []*calendar.CalendarListEntry) []*calendarData {
+	receivedCals := make(map[string]*calendar.CalendarListEntry, 0)
+	for _, c := range calendars {
+		receivedCals[c.Id] = c
+	}
+
+	var approved []*calendarData
+	for _, approvedCal := range acct.Calendars {
+		c, ok := receivedCals[approvedCal.ID]
+		if !ok {
+			err := fmt.Errorf("calendar not found in the calendar list of %s", acct.Name)
+			fmt.Fprintf(os.Stderr, "%s: %s: %v\n", acct.Name, approvedCal.ID, err)
+			approved = append(approved, &calendarData{conf: approvedCal, err: err})
+			continue
+		}
+		approved = append(approved, &calendarData{conf: approvedCal, entry: c})
+	}
+	return approved
+}
+
+// printError writes a failed account or calendar as an ERROR heading, so the
+// failure shows up in the agenda instead of the events quietly going missing.
+func printError(w io.Writer, what string, err error) {
+	fmt.Fprintf(w, "* ERROR %s\n", what)
+	for _, l := range strings.Split(err.Error(), "\n") {
+		fmt.Fprintf(w, "  %s\n", l)
+	}
+	fmt.Fprintln(w)
+}
+
+func (l layout) printAccount(w io.Writer, data *accountData) error {
+	if data.err != nil {
+		printError(w, data.acct.Name, data.err)
+		return nil
+	}
+	for _, cd := range data.calendars {
+		if cd.err != nil {
+			printError(w, data.acct.Name+": "+cd.conf.ID, cd.err)
+			continue
+		}
+		if err := l.tmpl.writeCalendar(w, data.acct, cd); err != nil {
+			return fmt.Errorf("calendar %s: %w", cd.conf.ID, err)
+		}
+
+		groups := calendarGroups(data.acct, cd)
+		l.sortGroups(groups)
+		for _, g := range groups {
+			if err := l.tmpl.writeEvent(w, g, 2, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// printAccountErrors writes the ERROR headings of an account for layouts
+// without calendar headings to put them in.
+func printAccountErrors(w io.Writer, data *accountData) {
+	if data.err != nil {
+		printError(w, data.acct.Name, data.err)
+		return
+	}
+	for _, cd := range data.calendars {
+		if cd.err != nil {
+			printError(w, data.acct.Name+": "+cd.conf.ID, cd.err)
+		}
+	}
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"os/user"
-	"path/filepath"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
@@ -18,91 +22,392 @@ import (
 	"google.golang.org/api/calendar/v3"
 )
 
+// savingTokenSource hands out the account's tokens, writing them back to
+// the token cache whenever they are refreshed. If the refresh token stopped
+// working it runs the web flow again when someone is there to click through
+// it. Its errors are auth errors, so they keep their exit code when they
+// surface from inside an API call.
+type savingTokenSource struct {
+	ctx    context.Context
+	acct   *account
+	config *oauth2.Config
+
+	mu   sync.Mutex
+	src  oauth2.TokenSource
+	last storedToken
+}
+
+func newSavingTokenSource(ctx context.Context, acct *account, config *oauth2.Config, tok *storedToken) *savingTokenSource {
+	return &savingTokenSource{ctx: ctx, acct: acct, config: config,
+		src: config.TokenSource(ctx, &tok.Token), last: *tok}
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tok, err := s.src.Token()
+	if err != nil {
+		if !isInvalidGrant(err) {
+			return nil, authError(fmt.Errorf("%s: unable to refresh token: %w", s.acct.Name, err))
+		}
+		if !interactive() {
+			return nil, authError(fmt.Errorf("%s: authorization expired or was revoked, run 'gcalorg auth %s'",
+				s.acct.Name, s.acct.Name))
+		}
+		fmt.Fprintf(os.Stderr, "%s: authorization expired or was revoked, authorizing again\n", s.acct.Name)
+		st, err := authorize(s.acct, s.config, s.last.Scopes, true)
+		if err != nil {
+			return nil, err
+		}
+		s.last = *st
+		s.src = s.config.TokenSource(s.ctx, &st.Token)
+		return &st.Token, nil
+	}
+
+	if tok.AccessToken != s.last.AccessToken || tok.RefreshToken != s.last.RefreshToken {
+		st := &storedToken{Token: *tok, Scopes: s.last.Scopes}
+		if err := s.acct.tokens.save(s.acct.Name, st); err != nil {
+			// The token still works for this run, the next one refreshes again.
+			fmt.Fprintf(os.Stderr, "%s: unable to save refreshed token: %v\n", s.acct.Name, err)
+		}
+		s.last = *st
+	}
+	return tok, nil
+}
+
+// isInvalidGrant reports whether err is the token endpoint refusing our
+// refresh token, as it does once it's revoked or expired.
+func isInvalidGrant(err error) bool {
+	return strings.Contains(err.Error(), "invalid_grant")
+}
+
+// interactive reports whether there is probably a user watching, as opposed
+// to running from cron with stderr going to a log.
+func interactive() bool {
+	fi, err := os.Stderr.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
 // getClient uses a Context and Config to retrieve a Token
 // then generate a Client. It returns the generated Client.
-func getClient(filename string, ctx context.Context, config *oauth2.Config) *http.Client {
-	cacheFile, err := tokenCacheFile(filename)
-	if err != nil {
-		log.Fatalf("Unable to get path to cached credential file. %v", err)
+func getClient(acct *account, ctx context.Context, config *oauth2.Config) (*http.Client, error) {
+	want := config.Scopes[0]
+	tok, err := loadToken(acct)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		tok, err = authorize(acct, config, nil, true)
+	case err == nil && !scopeCovers(tok.Scopes, want):
+		// Ask for just what this command needs, on top of what was granted.
+		if !interactive() {
+			return nil, authError(fmt.Errorf("this needs %s access, run 'gcalorg auth --write %s'",
+				shortScope(want), acct.Name))
+		}
+		fmt.Fprintf(os.Stderr, "%s: this needs %s access, authorizing it\n", acct.Name, shortScope(want))
+		tok, err = authorize(acct, config, tok.Scopes, true)
 	}
-	tok, err := tokenFromFile(cacheFile)
 	if err != nil {
-		tok = getTokenFromWeb(config)
-		saveToken(cacheFile, tok)
+		return nil, err
 	}
-	return config.Client(ctx, tok)
+	src := newSavingTokenSource(ctx, acct, config, tok)
+	return oauth2.NewClient(ctx, src), nil
 }
 
-// getTokenFromWeb uses Config to request a Token.
-// It returns the retrieved Token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", authURL)
+// authTimeout is how long getTokenFromWeb waits for the browser to come back.
+const authTimeout = 5 * time.Minute
 
-	var code string
-	if _, err := fmt.Scan(&code); err != nil {
-		log.Fatalf("Unable to read authorization code %v", err)
+// getTokenFromWeb runs the loopback flow: it listens on a local port, sends
+// the user to the consent page with that as the redirect uri, and exchanges
+// the code google redirects back with. The browser is opened for the user
+// when browse is set and one can be found, else the link is printed.
+func getTokenFromWeb(config *oauth2.Config, browse bool) (*oauth2.Token, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, authError(fmt.Errorf("unable to listen for the oauth redirect: %w", err))
 	}
+	defer ln.Close()
 
-	tok, err := config.Exchange(oauth2.NoContext, code)
+	state, err := randomState()
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web %v", err)
+		return nil, authError(fmt.Errorf("unable to make oauth state: %w", err))
 	}
-	return tok
-}
+	c := *config
+	c.RedirectURL = fmt.Sprintf("http://%s/", ln.Addr())
+	authURL := c.AuthCodeURL(state, oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("include_granted_scopes", "true"))
 
-// tokenCacheFile generates credential file path/filename.
-// It returns the generated credential path/filename.
-func tokenCacheFile(filename string) (string, error) {
-	tokname := filepath.Base(filename)
-	usr, err := user.Current()
+	type result struct {
+		code string
+		err  error
+	}
+	done := make(chan result, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var res result
+		switch {
+		case q.Get("state") != state:
+			// Not ours, maybe a stale tab; keep waiting for the real one.
+			http.Error(w, "state mismatch", http.StatusBadRequest)
+			return
+		case q.Get("error") != "":
+			res.err = fmt.Errorf("authorization denied: %s", q.Get("error"))
+		case q.Get("code") == "":
+			res.err = fmt.Errorf("no authorization code in redirect")
+		default:
+			res.code = q.Get("code")
+		}
+		if res.err != nil {
+			fmt.Fprintf(w, "gcalorg: %v\n", res.err)
+		} else {
+			fmt.Fprintln(w, "gcalorg is authorized, you can close this window.")
+		}
+		select {
+		case done <- res:
+		default:
+		}
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	if !browse || openBrowser(authURL) != nil {
+		fmt.Fprintf(os.Stderr, "Go to the following link in your browser to authorize gcalorg:\n%v\n", authURL)
+	} else {
+		fmt.Fprintf(os.Stderr, "Opened your browser to authorize gcalorg, if it didn't show up go to:\n%v\n", authURL)
+	}
+
+	var res result
+	select {
+	case res = <-done:
+	case <-time.After(authTimeout):
+		return nil, authError(fmt.Errorf("timed out waiting for authorization"))
+	}
+	if res.err != nil {
+		return nil, authError(res.err)
+	}
+
+	tok, err := c.Exchange(oauth2.NoContext, res.code)
 	if err != nil {
+		return nil, authError(fmt.Errorf("unable to retrieve token from web: %w", err))
+	}
+	return tok, nil
+}
+
+// randomState returns an unguessable oauth state parameter.
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
-	tokenCacheDir := filepath.Join(usr.HomeDir, ".credentials")
-	os.MkdirAll(tokenCacheDir, 0700)
-	return filepath.Join(tokenCacheDir,
-		url.QueryEscape(fmt.Sprintf("calendar-api-quickstart.%s.json", tokname))), err
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-// tokenFromFile retrieves a Token from a given file path.
-// It returns the retrieved Token and any read error encountered.
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
+// openBrowser opens url in the user's browser, if there is one.
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		if os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			return fmt.Errorf("no display")
+		}
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
+
+// authorize runs the web flow for the scopes of config and also, and saves
+// the token with the scopes google granted.
+func authorize(acct *account, config *oauth2.Config, also []string, browse bool) (*storedToken, error) {
+	c := *config
+	c.Scopes = addScopes(config.Scopes, also)
+	tok, err := getTokenFromWeb(&c, browse)
 	if err != nil {
 		return nil, err
 	}
-	t := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(t)
-	defer f.Close()
-	return t, err
+	st := &storedToken{Token: *tok, Scopes: c.Scopes}
+	if granted, ok := tok.Extra("scope").(string); ok && granted != "" {
+		st.Scopes = strings.Fields(granted)
+	}
+	fmt.Fprintf(os.Stderr, "Saving token to: %s\n", acct.tokens.where(acct.Name))
+	if err := acct.tokens.save(acct.Name, st); err != nil {
+		return nil, authError(fmt.Errorf("unable to save oauth token: %w", err))
+	}
+	return st, nil
 }
 
-// saveToken uses a file path to create a file and store the
-// token in it.
-func saveToken(file string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", file)
-	f, err := os.Create(file)
-	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
+// calendarEventsScope allows changing events, but not calendars or who they
+// are shared with. The vendored calendar package predates it.
+const calendarEventsScope = "https://www.googleapis.com/auth/calendar.events"
+
+// writeScope is what push and respond ask for.
+const writeScope = calendarEventsScope
+
+// scopeCovers reports whether a token granted scopes can be used where want
+// is needed.
+func scopeCovers(granted []string, want string) bool {
+	for _, g := range granted {
+		if g == want || g == calendar.CalendarScope {
+			return true
+		}
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
+	return false
 }
 
-func genClient(filename string) *http.Client {
-	ctx := context.Background()
+// addScopes returns scopes with the ones in more it doesn't have yet.
+func addScopes(scopes, more []string) []string {
+	all := append([]string(nil), scopes...)
+	for _, s := range more {
+		if !scopeCovers(all, s) {
+			all = append(all, s)
+		}
+	}
+	return all
+}
 
+// shortScope drops the url part of a scope, e.g. calendar.readonly.
+func shortScope(scope string) string {
+	return strings.TrimPrefix(scope, "https://www.googleapis.com/auth/")
+}
+
+// oauthConfig reads the client secret file and builds the oauth2 config for
+// it.
+func oauthConfig(filename, scope string) (*oauth2.Config, error) {
 	b, err := ioutil.ReadFile(filename)
 	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
+		return nil, configError(fmt.Errorf("unable to read client secret file: %w", err))
+	}
+
+	config, err := google.ConfigFromJSON(b, scope)
+	if err != nil {
+		return nil, configError(fmt.Errorf("unable to parse client secret file to config: %w", err))
+	}
+	return config, nil
+}
+
+// authErrSource marks token failures as auth errors, so they keep their
+// exit code when they surface from inside an API call.
+type authErrSource struct {
+	acct string
+	src  oauth2.TokenSource
+}
+
+func (s authErrSource) Token() (*oauth2.Token, error) {
+	tok, err := s.src.Token()
+	if err != nil {
+		return nil, authError(fmt.Errorf("%s: %w", s.acct, err))
 	}
+	return tok, nil
+}
 
-	config, err := google.ConfigFromJSON(b, calendar.CalendarReadonlyScope)
+// serviceAccountSource returns the token source of a service account,
+// impersonating the account's subject if it has one.
+func serviceAccountSource(ctx context.Context, acct *account, scope ...string) (oauth2.TokenSource, error) {
+	b, err := ioutil.ReadFile(acct.Key)
+	if err != nil {
+		return nil, configError(fmt.Errorf("unable to read service account key: %w", err))
+	}
+	conf, err := google.JWTConfigFromJSON(b, scope...)
 	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+		return nil, configError(fmt.Errorf("unable to parse service account key: %w", err))
 	}
+	conf.Subject = acct.Subject
+	return authErrSource{acct.Name, conf.TokenSource(ctx)}, nil
+}
 
-	return getClient(filename, ctx, config)
+// genClient returns a client for the account, authorized for scope, that
+// retries rate limited and failed calls.
+func genClient(acct *account, scope string) (*http.Client, error) {
+	ctx := context.Background()
+
+	var client *http.Client
+	if acct.Type == serviceAccount {
+		src, err := serviceAccountSource(ctx, acct, scope)
+		if err != nil {
+			return nil, err
+		}
+		client = oauth2.NewClient(ctx, src)
+	} else {
+		config, err := oauthConfig(acct.Secret, scope)
+		if err != nil {
+			return nil, err
+		}
+		if client, err = getClient(acct, ctx, config); err != nil {
+			return nil, err
+		}
+	}
+	client.Transport = newRetryTransport(client.Transport, acct.retry)
+	return client, nil
+}
+
+var authCmd = &command{
+	name:  "auth",
+	args:  "[flags] <account>",
+	short: "authorize an account and cache its token",
+	long: `
+Auth runs the oauth flow for the named account, replacing any cached
+token. Use it to set up a new account or after access was revoked.
+
+Accounts start out with read only access. Commands that change events ask
+for more when they first run; --write asks for it right away. Access
+granted before is kept either way.
+
+The consent page is opened in your browser and redirects back to a
+listener on 127.0.0.1, so the client secret has to be a "Desktop app"
+one. Use --no-browser to just print the link, e.g. over ssh with the
+port forwarded.
+
+Service accounts need no authorizing; for them auth only checks that a
+token can be had for the key and subject.
+`,
+	run: runAuth,
+}
+
+func runAuth(cmd *command, args []string) error {
+	fs := cmd.flags()
+	configPath := configFlag(fs)
+	write := fs.Bool("write", false, "also authorize changing events, as push and respond need")
+	noBrowser := fs.Bool("no-browser", false, "print the authorization link instead of opening a browser")
+	if err := cmd.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return usageError(fmt.Errorf("expected one account name"))
+	}
+
+	conf, err := loadConfig(*configPath)
+	if err != nil {
+		return configError(err)
+	}
+	acct, err := conf.account(fs.Arg(0))
+	if err != nil {
+		return configError(err)
+	}
+
+	scope := calendar.CalendarReadonlyScope
+	var also []string
+	if *write {
+		also = []string{writeScope}
+	}
+	if acct.Type == serviceAccount {
+		// Nothing to authorize, but check the key and delegation work.
+		src, err := serviceAccountSource(context.Background(), acct, addScopes([]string{scope}, also)...)
+		if err != nil {
+			return err
+		}
+		if _, err := src.Token(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%s: service account key works\n", acct.Name)
+		return nil
+	}
+	config, err := oauthConfig(acct.Secret, scope)
+	if err != nil {
+		return err
+	}
+	_, err = authorize(acct, config, also, !*noBrowser)
+	return err
 }
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// Orders of the event headings.
+const (
+	orderStart   = "start"   // by first start
+	orderNext    = "next"    // by next upcoming start, then past events, latest first
+	orderUpdated = "updated" // most recently changed first
+	orderTitle   = "title"
+	orderID      = "id"
+)
+
+var eventOrders = []string{orderStart, orderNext, orderUpdated, orderTitle, orderID}
+
+// Ways of grouping the event headings.
+const (
+	groupCalendar = "calendar" // under a heading per calendar
+	groupDay      = "day"      // under a heading per day
+	groupWeek     = "week"     // under a heading per ISO week
+	groupMerged   = "merged"   // all calendars together, without headings above
+)
+
+var eventGroupings = []string{groupCalendar, groupDay, groupWeek, groupMerged}
+
+// groupDatetree files event headings under year, month and day headings, the
+// way org-capture datetrees do. It's what --layout datetree picks.
+const groupDatetree = "datetree"
+
+// Layouts of the file.
+const (
+	layoutOutline  = "outline" // event headings grouped as --group says
+	layoutDatetree = "datetree"
+)
+
+var fileLayouts = []string{layoutOutline, layoutDatetree}
+
+// checkChoice returns an error unless v is one of choices.
+func checkChoice(what, v string, choices []string) error {
+	for _, c := range choices {
+		if v == c {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown %s %q, want one of %s", what, v, strings.Join(choices, ", "))
+}
+
+// layout is how export arranges the event headings.
+type layout struct {
+	order string
+	group string
+	now   time.Time
+	tmpl  *orgTemplates
+}
+
+// eventGroup is what goes under one event heading: a single event, or a
+// recurring event with its moved and cancelled occurrences.
+type eventGroup struct {
+	id     string
+	acct   *account
+	cal    *calendarConfig
+	events []*calendar.Event
+	head   *calendar.Event
+
+	// when is the time the group is ordered and grouped by: its next
+	// occurrence for orderNext, its first start otherwise. upcoming is
+	// whether that's still to come.
+	when     time.Time
+	upcoming bool
+}
+
+// calendarGroups returns the event groups of a fetched calendar, leaving out
+// filtered events.
+func calendarGroups(acct *account, cd *calendarData) []*eventGroup {
+	by_event_id := make(map[string]*calendar.Event, len(cd.events))
+	for _, v := range cd.events {
+		by_event_id[v.Id] = v
+	}
+	events_by_id := make(map[string][]*calendar.Event)
+	for _, v := range cd.events {
+		uid := v.ICalUID
+		if master, ok := by_event_id[v.RecurringEventId]; ok && uid == "" {
+			// cancelled occurrences may only know their master.
+			uid = master.ICalUID
+		}
+		recur_id := strings.Split(uid, "_R")[0]
+		events_by_id[recur_id] = append(events_by_id[recur_id], v)
+	}
+
+	var groups []*eventGroup
+	for id, events := range events_by_id {
+		head := groupHead(events)
+		if head == nil {
+			continue
+		}
+		if filteredEvent(cd.conf, head.Summary) {
+			continue
+		}
+		groups = append(groups, &eventGroup{id: id, acct: acct, cal: cd.conf, events: events, head: head})
+	}
+	return groups
+}
+
+// firstStart returns the earliest start of the events of g.
+func (g *eventGroup) firstStart() time.Time {
+	var first time.Time
+	for _, e := range g.events {
+		if t := eventStart(e); !t.IsZero() && (first.IsZero() || t.Before(first)) {
+			first = t
+		}
+	}
+	return first
+}
+
+// nextStart returns the start of the first occurrence in g that hasn't ended
+// by now. ok is false if they're all over.
+func (g *eventGroup) nextStart(now time.Time) (next time.Time, ok bool) {
+	for _, e := range g.events {
+		if isCancelledOccurrence(e) {
+			continue
+		}
+		t := eventStart(e)
+		if rec, ok := parseRecurrence(e); ok {
+			t = rec.nextOccurrence(e, now)
+		} else if !eventEnd(e).After(now) {
+			continue
+		}
+		if !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// lastStart returns the latest start of the events of g.
+func (g *eventGroup) lastStart() time.Time {
+	var last time.Time
+	for _, e := range g.events {
+		if t := eventStart(e); t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+// sortGroups puts groups in the order of l.
+func (l layout) sortGroups(groups []*eventGroup) {
+	for _, g := range groups {
+		if l.order == orderNext {
+			if g.when, g.upcoming = g.nextStart(l.now); !g.upcoming {
+				g.when = g.lastStart()
+			}
+		} else {
+			g.when = g.firstStart()
+		}
+	}
+
+	// Ids keep the order stable between runs when the keys tie.
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].id < groups[j].id
+	})
+	sort.SliceStable(groups, func(i, j int) bool {
+		a, b := groups[i], groups[j]
+		switch l.order {
+		case orderStart:
+			return a.when.Before(b.when)
+		case orderNext:
+			if a.upcoming != b.upcoming {
+				return a.upcoming
+			}
+			if a.upcoming {
+				return a.when.Before(b.when)
+			}
+			return a.when.After(b.when)
+		case orderUpdated:
+			return a.head.Updated > b.head.Updated
+		case orderTitle:
+			return strings.ToLower(a.head.Summary) < strings.ToLower(b.head.Summary)
+		}
+		return false
+	})
+}
+
+// bucket returns the heading of the day or week g goes under, and when that
+// day or week starts.
+func (l layout) bucket(g *eventGroup) (title string, start time.Time) {
+	if g.when.IsZero() {
+		return "No date", time.Time{}
+	}
+	t := g.when.In(time.Local)
+	day := startOfDay(t)
+	if l.group == groupDay {
+		return day.Format("2006-01-02 Monday"), day
+	}
+	year, week := t.ISOWeek()
+	monday := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	return fmt.Sprintf("%d-W%02d", year, week), monday
+}
+
+// printEvents writes the fetched accounts the way l arranges them.
+func (l layout) printEvents(w io.Writer, results []*accountData) error {
+	if l.group == groupCalendar {
+		for _, data := range results {
+			if err := l.printAccount(w, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var groups []*eventGroup
+	for _, data := range results {
+		printAccountErrors(w, data)
+		if data.err != nil {
+			continue
+		}
+		for _, cd := range data.calendars {
+			if cd.err == nil {
+				groups = append(groups, calendarGroups(data.acct, cd)...)
+			}
+		}
+	}
+	l.sortGroups(groups)
+
+	switch l.group {
+	case groupMerged:
+		for _, g := range groups {
+			if err := l.tmpl.writeEvent(w, g, 1, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	case groupDatetree:
+		return l.printDatetree(w, groups)
+	}
+
+	// The buckets go in time order, and keep the order of l inside.
+	type bucketed struct {
+		title  string
+		start  time.Time
+		groups []*eventGroup
+	}
+	var buckets []*bucketed
+	byTitle := make(map[string]*bucketed)
+	for _, g := range groups {
+		title, start := l.bucket(g)
+		b, ok := byTitle[title]
+		if !ok {
+			b = &bucketed{title: title, start: start}
+			byTitle[title] = b
+			buckets = append(buckets, b)
+		}
+		b.groups = append(b.groups, g)
+	}
+	sort.SliceStable(buckets, func(i, j int) bool {
+		if buckets[i].start.IsZero() != buckets[j].start.IsZero() {
+			return buckets[j].start.IsZero()
+		}
+		return buckets[i].start.Before(buckets[j].start)
+	})
+	for _, b := range buckets {
+		// Plain dates, so the agenda doesn't show the headings.
+		fmt.Fprintf(w, "* %s\n\n", b.title)
+		for _, g := range b.groups {
+			if err := l.tmpl.writeEvent(w, g, 2, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// printDatetree writes groups into a datetree, on the day of their start (or
+// next start, ordered by that). Inside a day they keep their order.
+func (l layout) printDatetree(w io.Writer, groups []*eventGroup) error {
+	day := func(g *eventGroup) time.Time {
+		if g.when.IsZero() {
+			return g.when
+		}
+		return startOfDay(g.when.In(time.Local))
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		a, b := day(groups[i]), day(groups[j])
+		if a.IsZero() != b.IsZero() {
+			return b.IsZero()
+		}
+		return a.Before(b)
+	})
+
+	// Only dates, so the agenda doesn't show the headings.
+	var year, month, date string
+	for _, g := range groups {
+		t := day(g)
+		if t.IsZero() {
+			if date != "No date" {
+				fmt.Fprintf(w, "* No date\n\n")
+				year, month, date = "", "", "No date"
+			}
+			if err := l.tmpl.writeEvent(w, g, 2, true); err != nil {
+				return err
+			}
+			continue
+		}
+		if y := t.Format("2006"); y != year {
+			fmt.Fprintf(w, "* %s\n", y)
+			year = y
+		}
+		if m := t.Format("2006-01 January"); m != month {
+			fmt.Fprintf(w, "** %s\n", m)
+			month = m
+		}
+		if d := t.Format("2006-01-02 Monday"); d != date {
+			fmt.Fprintf(w, "*** %s\n\n", d)
+			date = d
+		}
+		if err := l.tmpl.writeEvent(w, g, 4, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
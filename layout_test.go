@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+func TestDatetree(t *testing.T) {
+	inUTC(t)
+	tmpl, err := (&templateConfig{}).templates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timed := func(id, summary, start string) *calendar.Event {
+		st, _ := time.Parse(time.RFC3339, start)
+		return &calendar.Event{
+			Id: id, ICalUID: id, Summary: summary,
+			Start: &calendar.EventDateTime{DateTime: start},
+			End:   &calendar.EventDateTime{DateTime: st.Add(time.Hour).Format(time.RFC3339)},
+		}
+	}
+	allDay := func(id, summary, date, end string) *calendar.Event {
+		return &calendar.Event{
+			Id: id, ICalUID: id, Summary: summary,
+			Start: &calendar.EventDateTime{Date: date},
+			End:   &calendar.EventDateTime{Date: end},
+		}
+	}
+	weekly := timed("w1", "Weekly", "2026-10-05T10:00:00Z")
+	weekly.Recurrence = []string{"RRULE:FREQ=WEEKLY"}
+
+	tests := []struct {
+		name   string
+		order  string
+		events []*calendar.Event
+		want   []string
+	}{
+		{
+			name:  "by start",
+			order: orderStart,
+			events: []*calendar.Event{
+				timed("b", "Dinner", "2026-10-17T19:00:00Z"),
+				timed("a", "Lunch", "2026-10-17T12:00:00Z"),
+				allDay("c", "Trip", "2026-11-02", "2026-11-05"),
+				timed("d", "New year", "2027-01-01T00:30:00Z"),
+				timed("e", "Review", "2026-10-20T09:00:00Z"),
+				weekly,
+			},
+			want: []string{
+				"* 2026",
+				"** 2026-10 October",
+				"*** 2026-10-05 Monday",
+				"**** Weekly :WORK:",
+				"*** 2026-10-17 Saturday",
+				"**** Lunch :WORK:",
+				"**** Dinner :WORK:",
+				"*** 2026-10-20 Tuesday",
+				"**** Review :WORK:",
+				"** 2026-11 November",
+				"*** 2026-11-02 Monday",
+				"**** Trip :WORK:",
+				"* 2027",
+				"** 2027-01 January",
+				"*** 2027-01-01 Friday",
+				"**** New year :WORK:",
+			},
+		},
+		{
+			name:  "by next start",
+			order: orderNext,
+			events: []*calendar.Event{
+				timed("a", "Lunch", "2026-10-17T12:00:00Z"),
+				timed("e", "Review", "2026-10-20T09:00:00Z"),
+				timed("p", "Past", "2026-09-01T09:00:00Z"),
+				weekly,
+			},
+			want: []string{
+				"* 2026",
+				"** 2026-09 September",
+				"*** 2026-09-01 Tuesday",
+				"**** Past :WORK:",
+				"** 2026-10 October",
+				"*** 2026-10-17 Saturday",
+				"**** Lunch :WORK:",
+				"*** 2026-10-19 Monday",
+				"**** Weekly :WORK:",
+				"*** 2026-10-20 Tuesday",
+				"**** Review :WORK:",
+			},
+		},
+		{
+			name:  "no date",
+			order: orderStart,
+			events: []*calendar.Event{
+				{Id: "x", ICalUID: "x", Summary: "Someday"},
+				timed("a", "Lunch", "2026-10-17T12:00:00Z"),
+			},
+			want: []string{
+				"* 2026",
+				"** 2026-10 October",
+				"*** 2026-10-17 Saturday",
+				"**** Lunch :WORK:",
+				"* No date",
+				"** Someday :WORK:",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cal := &calendarConfig{ID: "me@x.com"}
+			acct := &account{Name: "work", Tag: "WORK", Calendars: []*calendarConfig{cal}}
+			results := []*accountData{{
+				acct: acct,
+				calendars: []*calendarData{{
+					conf:   cal,
+					entry:  &calendar.CalendarListEntry{Id: cal.ID},
+					events: tt.events,
+				}},
+			}}
+			l := layout{
+				order: tt.order,
+				group: groupDatetree,
+				now:   time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC),
+				tmpl:  tmpl,
+			}
+			var buf bytes.Buffer
+			if err := l.printEvents(&buf, results); err != nil {
+				t.Fatal(err)
+			}
+			var headings []string
+			for _, line := range strings.Split(buf.String(), "\n") {
+				if strings.HasPrefix(line, "*") {
+					headings = append(headings, line)
+				}
+			}
+			if !reflect.DeepEqual(headings, tt.want) {
+				t.Errorf("headings\n%s\nwant\n%s", strings.Join(headings, "\n"),
+					strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestBucket(t *testing.T) {
+	inUTC(t)
+	day := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		when      time.Time
+		group     string
+		wantTitle string
+		wantStart time.Time
+	}{
+		{day(2026, 10, 17), groupDay, "2026-10-17 Saturday", day(2026, 10, 17)},
+		{day(2026, 10, 17).Add(23 * time.Hour), groupDay, "2026-10-17 Saturday", day(2026, 10, 17)},
+		{day(2026, 10, 17), groupWeek, "2026-W42", day(2026, 10, 12)},
+		{day(2026, 10, 18).Add(20 * time.Hour), groupWeek, "2026-W42", day(2026, 10, 12)},
+		{day(2026, 10, 19), groupWeek, "2026-W43", day(2026, 10, 19)},
+		// 2026 starts on a Thursday, so it has 53 ISO weeks, and they
+		// start and end in the years next to it.
+		{day(2025, 12, 29), groupWeek, "2026-W01", day(2025, 12, 29)},
+		{day(2026, 12, 31), groupWeek, "2026-W53", day(2026, 12, 28)},
+		{day(2027, 1, 3).Add(12 * time.Hour), groupWeek, "2026-W53", day(2026, 12, 28)},
+		{day(2027, 1, 4), groupWeek, "2027-W01", day(2027, 1, 4)},
+		{time.Time{}, groupWeek, "No date", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.group+" "+tt.when.Format(time.RFC3339), func(t *testing.T) {
+			title, start := layout{group: tt.group}.bucket(&eventGroup{when: tt.when})
+			if title != tt.wantTitle || !start.Equal(tt.wantStart) {
+				t.Errorf("bucket() = %q, %v, want %q, %v", title, start, tt.wantTitle, tt.wantStart)
+			}
+		})
+	}
+}
+
+func TestSortGroupsNext(t *testing.T) {
+	inUTC(t)
+	group := func(id, start, end string, recurrence ...string) *eventGroup {
+		e := &calendar.Event{
+			Id: id, ICalUID: id, Summary: id, Recurrence: recurrence,
+			Start: &calendar.EventDateTime{DateTime: start},
+			End:   &calendar.EventDateTime{DateTime: end},
+		}
+		return &eventGroup{id: id, events: []*calendar.Event{e}, head: e}
+	}
+	groups := []*eventGroup{
+		group("long past", "2026-09-01T09:00:00Z", "2026-09-01T10:00:00Z"),
+		group("tomorrow", "2026-10-18T09:00:00Z", "2026-10-18T10:00:00Z"),
+		group("just past", "2026-10-17T06:00:00Z", "2026-10-17T07:00:00Z"),
+		group("weekly", "2026-10-05T10:00:00Z", "2026-10-05T11:00:00Z", "RRULE:FREQ=WEEKLY"),
+		group("ongoing", "2026-10-17T07:30:00Z", "2026-10-17T09:00:00Z"),
+		group("also tomorrow", "2026-10-18T09:00:00Z", "2026-10-18T10:00:00Z"),
+	}
+	l := layout{order: orderNext, now: time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC)}
+	l.sortGroups(groups)
+
+	var got []string
+	for _, g := range groups {
+		got = append(got, g.id)
+	}
+	// Upcoming soonest first, ties by id, then past events latest first.
+	want := []string{"ongoing", "also tomorrow", "tomorrow", "weekly", "just past", "long past"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("order %q, want %q", got, want)
+	}
+	if w := groups[3].when; !w.Equal(time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("weekly is ordered by %v, want its next occurrence", w)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// lockFile takes the lock at path by creating it. ok is false if it already
+// exists; a run that crashed leaves it behind, to be removed by hand.
+func lockFile(path string) (unlock func(), ok bool, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	f.Close()
+	return func() { os.Remove(path) }, true, nil
+}
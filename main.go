@@ -1,143 +1,202 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
-	"log"
-	"net/http"
+	"io"
 	"os"
-	"sort"
 	"strings"
-	"time"
 
-	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
 )
 
-func printCalendars(client *http.Client, approvedCals []string, tagname string) {
-	srv, err := calendar.New(client)
-	if err != nil {
-		log.Fatalf("Unable to retrieve calendar Client %v", err)
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// Exit codes, so scripts can tell what kind of failure happened.
+const (
+	exitOK     = 0
+	exitFail   = 1 // anything not covered below
+	exitUsage  = 2
+	exitConfig = 3
+	exitAuth   = 4
+	exitAPI    = 5
+)
+
+// cmdError carries the exit code an error should produce.
+type cmdError struct {
+	code int
+	err  error
+}
+
+func (e *cmdError) Error() string { return e.err.Error() }
+func (e *cmdError) Unwrap() error { return e.err }
+
+func usageError(err error) error  { return &cmdError{exitUsage, err} }
+func configError(err error) error { return &cmdError{exitConfig, err} }
+func authError(err error) error   { return &cmdError{exitAuth, err} }
+
+// apiError marks err as a failure talking to the calendar API, unless it was
+// already classified further down (e.g. a token refresh failing in the middle
+// of a request).
+func apiError(err error) error {
+	var ce *cmdError
+	if errors.As(err, &ce) {
+		return err
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == 401 {
+		return authError(err)
 	}
+	return &cmdError{exitAPI, err}
+}
 
-	// find all calendars
-	calendars, err := srv.CalendarList.List().ShowHidden(false).ShowDeleted(false).
-		MaxResults(250).Do()
-	if err != nil {
-		log.Fatalf("Unable to list calendars! %v", err)
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var ce *cmdError
+	if errors.As(err, &ce) {
+		return ce.code
 	}
+	return exitFail
+}
 
-	curtime := time.Now().UTC().Add(24 * time.Hour).Truncate(24 * time.Hour)
-	timeMin := curtime.AddDate(0, -9, 0).Format("2006-01-02T15:04:05Z")
-	timeMax := curtime.AddDate(1, 0, 0).Format("2006-01-02T15:04:05Z")
+// command is a gcalorg subcommand.
+type command struct {
+	name  string
+	args  string
+	short string
+	long  string
+	run   func(cmd *command, args []string) error
+}
 
-	receivedCals := make(map[string]*calendar.CalendarListEntry, 0)
-	for _, c := range calendars.Items {
-		receivedCals[c.Id] = c
+var commands []*command
+
+func init() {
+	commands = []*command{
+		exportCmd,
+		calendarsCmd,
+		pushCmd,
+		respondCmd,
+		authCmd,
+		accountsCmd,
+		migrateCmd,
+		{
+			name:  "version",
+			short: "print the gcalorg version",
+			run:   runVersion,
+		},
+		{
+			name:  "help",
+			args:  "[command]",
+			short: "show help for a command",
+			run:   runHelp,
+		},
 	}
-	fmt.Printf("# -*- eval: (auto-revert-mode 1); -*-\n")
-	fmt.Printf("#+category: cal\n")
-	for _, approvedCal := range approvedCals {
+}
 
-		c, ok := receivedCals[approvedCal]
-		if !ok {
-			continue
-		}
-		fmt.Printf("* %s :%s:\n", noTodoKwds(c.Summary), tagname)
-		fmt.Printf("  :PROPERTIES:\n")
-		fmt.Printf("  :ID:         %s\n", c.Id)
-		fmt.Printf("  :END:\n")
-		fmt.Printf("\n%s\n\n", c.Description)
-
-		npt := ""
-		notdone := true
-
-		event_list := make([]*calendar.Event, 0, 250)
-		for notdone {
-			eventsReq := srv.Events.List(c.Id).ShowDeleted(false).
-				SingleEvents(true).TimeMin(timeMin).TimeMax(timeMax).MaxResults(250)
-			if npt != "" {
-				eventsReq = eventsReq.PageToken(npt)
-				npt = ""
-			}
-
-			events, err := eventsReq.Do()
-			if err != nil {
-				log.Fatalf("Unable to retrieve next ten of the user's events. %v", err)
-			}
-
-			notdone = events.NextPageToken != ""
-			if notdone {
-				npt = events.NextPageToken
-			}
-
-			event_list = append(event_list, events.Items...)
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
 		}
+	}
+	return nil
+}
 
-		events_by_id := make(map[string][]*calendar.Event)
-		for _, v := range event_list {
-			recur_id := strings.Split(v.ICalUID, "_R")[0]
-			events_by_id[recur_id] = append(events_by_id[recur_id], v)
-		}
+// flags returns a flag set for the command whose usage prints the command's
+// help text.
+func (c *command) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		c.usage(fs.Output())
+		fmt.Fprintf(fs.Output(), "\nflags:\n")
+		fs.PrintDefaults()
+	}
+	return fs
+}
 
-		type eventWithId struct {
-			id     string
-			events []*calendar.Event
-		}
+func (c *command) usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: gcalorg %s %s\n", c.name, c.args)
+	if c.long != "" {
+		fmt.Fprintf(w, "\n%s\n", strings.TrimSpace(c.long))
+	} else {
+		fmt.Fprintf(w, "\n%s\n", c.short)
+	}
+}
 
-		// sorted events
-		sorted_by_id := make([]eventWithId, 0, len(events_by_id))
-		for id, events := range events_by_id {
-			sorted_by_id = append(sorted_by_id,
-				eventWithId{id, events})
+// parse parses args into fs, turning parse failures into usage errors.
+func (c *command) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
 		}
+		return usageError(err)
+	}
+	return nil
+}
 
-		sort.Slice(sorted_by_id, func(i, j int) bool {
-			return sorted_by_id[i].id < sorted_by_id[j].id
-		})
-
-		for _, e := range sorted_by_id {
-			events := e.events
-			if len(events) == 0 {
-				continue
-			}
-			// skip things that are chatty (repeating calendar
-			// events -> org-mode has been difficult, manually
-			// manage those for now. There is probably a way of
-			// getting them, but converting the ical format to the
-			// org format would be a significant piece of logic)
-			if filteredEvent(c.Id, events[0].Summary) {
-				continue
-			}
-
-			fmt.Println(fmtEventGroup(c.Id, events))
-		}
+// configFlag adds the --config flag every command that reads the config
+// takes.
+func configFlag(fs *flag.FlagSet) *string {
+	return fs.String("config", "", "path to the config file "+
+		"(default $XDG_CONFIG_HOME/gcalorg/config.toml)")
+}
+
+func runVersion(cmd *command, args []string) error {
+	fs := cmd.flags()
+	if err := cmd.parse(fs, args); err != nil {
+		return err
 	}
+	fmt.Printf("gcalorg %s\n", version)
+	return nil
+}
+
+func runHelp(cmd *command, args []string) error {
+	if len(args) == 0 {
+		usage(os.Stdout)
+		return nil
+	}
+	c := findCommand(args[0])
+	if c == nil {
+		return usageError(fmt.Errorf("unknown command %q", args[0]))
+	}
+	if c.run == nil {
+		c.usage(os.Stdout)
+		return nil
+	}
+	return c.run(c, []string{"-help"})
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: gcalorg <command> [flags] [args]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.short)
+	}
+	fmt.Fprintf(w, "\nRun 'gcalorg help <command>' for details.\n")
 }
 
 func main() {
-	home := os.Getenv("HOME")
-	type caldata struct {
-		name    string
-		cals    []string
-		tagname string
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(exitUsage)
 	}
-	secrets := []caldata{
-		{
-			home + "/go/src/github.com/codemac/gcalorg/jmickeygoogle_secret.json",
-			workCals,
-			"WORK",
-		},
-		{
-			home + "/go/src/github.com/codemac/gcalorg/codemacgmail_secret.json",
-			gmailCals,
-			"HOME",
-		},
+
+	cmd := findCommand(os.Args[1])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "gcalorg: unknown command %q\n\n", os.Args[1])
+		usage(os.Stderr)
+		os.Exit(exitUsage)
 	}
 
-	// we need to sort before we do much of anything, so things show up in a
-	// decent order.
-	for _, v := range secrets {
-		fmt.Fprintf(os.Stderr, "Getting client for: %s", v.name)
-		cl := genClient(v.name)
-		printCalendars(cl, v.cals, v.tagname)
+	err := cmd.run(cmd, os.Args[2:])
+	if err == flag.ErrHelp {
+		os.Exit(exitOK)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gcalorg %s: %v\n", cmd.name, err)
 	}
+	os.Exit(exitCode(err))
 }
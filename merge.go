@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// generatedProperties are the event properties gcalorg writes. Any others
+// were added to the heading and are kept when merging.
+var generatedProperties = map[string]bool{
+	"ID":           true,
+	"CALENDAR":     true,
+	"GCALLINK":     true,
+	"ETAG":         true,
+	"CREATOR":      true,
+	"ORGANIZER":    true,
+	"LOCATION":     true,
+	"MEETING":      true,
+	"STATUS":       true,
+	"TRANSPARENCY": true,
+	"VISIBILITY":   true,
+	"COLOR":        true,
+	"CREATED":      true,
+	"UPDATED":      true,
+	"SEQUENCE":     true,
+	"GCALLINES":    true,
+	"GCALGONE":     true,
+}
+
+// generatedTags are the tags gcalorg puts on event headings.
+var generatedTags = map[string]bool{
+	"ARCHIVE": true,
+	freeTag:   true,
+}
+
+// mergeOutput merges the fresh export data into the file at path, keeping
+// what was added to the file since the last export, see mergeOrg. data is
+// returned as is if there's no file yet.
+func mergeOutput(path string, data []byte, cals map[string]exportedCalendar) ([]byte, error) {
+	old, err := readOrgFile(path)
+	if os.IsNotExist(err) {
+		old = &orgFile{}
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to merge into %s: %w", path, err)
+	}
+	f, err := parseOrg(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	mergeOrg(old, f, cals)
+	var buf bytes.Buffer
+	if err := f.write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// exportedCalendar is what merging needs to know of a configured calendar.
+type exportedCalendar struct {
+	tag     string // the tag of its events outside its heading
+	fetched bool   // in this run, or rendered from a snapshot
+
+	// deleted are the iCalUIDs of events deleted in google calendar, with
+	// when the deletion was seen.
+	deleted map[string]time.Time
+}
+
+// eventKey identifies an event heading across exports.
+type eventKey struct{ cal, id string }
+
+// eventKeyOf returns the key of an event heading gcalorg wrote, ok is false
+// for any other heading. Those have an :ID: too when they're calendars or
+// use org-id, but no :GCALLINK: or :GCALLINES:.
+func eventKeyOf(h *orgHeading) (key eventKey, ok bool) {
+	id, ok := h.property("ID")
+	if !ok {
+		return key, false
+	}
+	_, link := h.property("GCALLINK")
+	_, lines := h.property("GCALLINES")
+	if !link && !lines {
+		return key, false
+	}
+	cal := h.calendarID()
+	return eventKey{cal, id}, cal != ""
+}
+
+// mergeOrg carries what was added to the previous export old over into the
+// fresh export f. Event headings are matched up by calendar and :ID:, and
+// keep their todo keyword, priority, tags, properties, planning lines,
+// LOGBOOK, notes after the generated text and subheadings. Everything else
+// is regenerated. Headings written before there was :GCALLINES: keep all
+// their text as notes, there's no telling what of it was added.
+//
+// cals are the configured calendars by id. Events that aren't in the export
+// anymore are never dropped: those deleted in google calendar are tagged
+// ARCHIVE with the time of the deletion in :GCALGONE:, and the rest, like
+// events that left the export window, are kept as they are. So are the
+// headings of calendars that failed and headings gcalorg didn't write, like
+// new events waiting to be pushed.
+func mergeOrg(old, f *orgFile, cals map[string]exportedCalendar) {
+	oldEvents := make(map[eventKey]*orgHeading)
+	old.walk(func(h *orgHeading) {
+		if key, ok := eventKeyOf(h); ok {
+			if _, dup := oldEvents[key]; !dup {
+				oldEvents[key] = h
+			}
+		}
+	})
+
+	f.walk(func(h *orgHeading) {
+		key, ok := eventKeyOf(h)
+		if !ok {
+			return
+		}
+		h.setProperty("GCALLINES", strconv.Itoa(len(h.sections().generated)))
+		if o, ok := oldEvents[key]; ok {
+			mergeHeading(h, o, cals[key.cal].tag)
+			delete(oldEvents, key)
+		}
+	})
+
+	m := &merger{missing: oldEvents, cals: cals}
+	f.headings = append(f.headings, m.carry(old.headings, f.headings)...)
+
+	var settings []string
+	for _, l := range old.preamble {
+		if strings.HasPrefix(l, "#+") && !contains(f.preamble, l) {
+			settings = append(settings, l)
+		}
+	}
+	f.preamble = append(f.preamble, settings...)
+}
+
+// merger carries headings of the previous export over into the new one.
+type merger struct {
+	// missing are the event headings that weren't exported again.
+	missing map[eventKey]*orgHeading
+
+	cals map[string]exportedCalendar
+}
+
+// carry returns which of the old headings hs to keep among their new
+// siblings dst. Headings gcalorg wrote other than events, like calendars,
+// days or the years and months of a datetree, are matched up with dst by
+// their :ID: or title, and what is kept of their children is added to
+// their match.
+func (m *merger) carry(hs, dst []*orgHeading) []*orgHeading {
+	var kept []*orgHeading
+	for _, oh := range hs {
+		if key, ok := eventKeyOf(oh); ok {
+			if _, missing := m.missing[key]; missing {
+				if when, deleted := m.cals[key.cal].deleted[key.id]; deleted {
+					markGone(oh, when)
+				}
+				kept = append(kept, oh)
+			}
+			continue
+		}
+		if _, title, _ := oh.title(); oh.level == 1 && strings.HasPrefix(title, "ERROR ") {
+			continue
+		}
+		if id, ok := m.calendarHeading(oh); ok && !m.cals[id].fetched {
+			// The calendar failed, its events may well still be there.
+			kept = append(kept, oh)
+			continue
+		}
+		if !m.isGenerated(oh) {
+			kept = append(kept, oh)
+			continue
+		}
+		if h := matchHeading(oh, dst); h != nil {
+			h.children = append(h.children, m.carry(oh.children, h.children)...)
+			continue
+		}
+		// No event is on that day now, but some may be kept.
+		if oh.children = m.carry(oh.children, nil); len(oh.children) > 0 {
+			kept = append(kept, oh)
+		}
+	}
+	return kept
+}
+
+// calendarHeading returns the calendar id of h if it's the heading of a
+// configured calendar.
+func (m *merger) calendarHeading(h *orgHeading) (id string, ok bool) {
+	id, ok = h.property("ID")
+	if !ok || h.level != 1 {
+		return "", false
+	}
+	_, ok = m.cals[id]
+	return id, ok
+}
+
+// groupTitleRE matches the titles of the headings export groups events
+// under by date: days and weeks, and the years, months and days of a
+// datetree.
+var groupTitleRE = regexp.MustCompile(`^(No date|\d{4}(-W\d\d|-\d\d \pL+|-\d\d-\d\d \pL+)?)$`)
+
+// isGenerated reports whether h is a calendar or other heading gcalorg
+// wrote to put events under.
+func (m *merger) isGenerated(h *orgHeading) bool {
+	if _, ok := m.calendarHeading(h); ok {
+		return true
+	}
+	if _, ok := h.property("ID"); ok {
+		return false
+	}
+	if _, title, _ := h.title(); !groupTitleRE.MatchString(title) {
+		return false
+	}
+	return hasEvents(h)
+}
+
+// hasEvents reports whether there are event headings below h.
+func hasEvents(h *orgHeading) bool {
+	for _, c := range h.children {
+		if _, ok := eventKeyOf(c); ok || hasEvents(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHeading returns the heading in hs that is the new version of h.
+func matchHeading(h *orgHeading, hs []*orgHeading) *orgHeading {
+	id, hasID := h.property("ID")
+	_, title, _ := h.title()
+	for _, c := range hs {
+		if cid, ok := c.property("ID"); ok != hasID || cid != id {
+			continue
+		}
+		if _, ctitle, _ := c.title(); hasID || ctitle == title {
+			return c
+		}
+	}
+	return nil
+}
+
+var priorityRE = regexp.MustCompile(`^\[#.\] `)
+
+// mergeHeading gives the fresh event heading h what was added to its
+// previous version o. calTag is the tag of the event's calendar.
+func mergeHeading(h, o *orgHeading, calTag string) {
+	kwd, title, tags := o.title()
+	prio := priorityRE.FindString(title)
+	_, title, newTags := h.title()
+	for _, t := range tags {
+		if !generatedTags[t] && t != calTag && !contains(newTags, t) {
+			newTags = append(newTags, t)
+		}
+	}
+	h.line = headingLine(h.level, kwd, prio+title, newTags)
+
+	s, prev := h.sections(), o.sections()
+	if _, ok := o.property("GCALLINES"); !ok {
+		prev.notes, prev.generated = append(prev.generated, prev.notes...), nil
+	}
+	var lines []string
+	lines = append(lines, prev.planning...)
+	if n := len(s.drawer); n > 0 {
+		lines = append(lines, s.drawer[:n-1]...)
+		lines = append(lines, userProperties(prev.drawer)...)
+		lines = append(lines, s.drawer[n-1])
+	}
+	lines = append(lines, prev.drawers...)
+	lines = append(lines, s.generated...)
+	lines = append(lines, prev.notes...)
+	h.lines = lines
+	h.children = append(h.children, o.children...)
+}
+
+// headingLine puts a heading line back together.
+func headingLine(level int, kwd, title string, tags []string) string {
+	line := strings.Repeat("*", level) + " "
+	if kwd != "" {
+		line += kwd + " "
+	}
+	line += title
+	if len(tags) > 0 {
+		line += " :" + strings.Join(tags, ":") + ":"
+	}
+	return line
+}
+
+// userProperties returns the lines of a property drawer that gcalorg didn't
+// write.
+func userProperties(drawer []string) []string {
+	var props []string
+	for _, l := range drawer {
+		name, ok := propertyName(l)
+		if ok && !generatedProperties[name] {
+			props = append(props, l)
+		}
+	}
+	return props
+}
+
+var propertyRE = regexp.MustCompile(`^\s*:([^\s:]+):`)
+
+// propertyName returns the upper cased name of the property on line.
+func propertyName(line string) (string, bool) {
+	m := propertyRE.FindStringSubmatch(line)
+	if m == nil {
+		return "", false
+	}
+	name := strings.ToUpper(m[1])
+	return name, name != "PROPERTIES" && name != "END"
+}
+
+// markGone tags the event heading h as deleted from the calendar, keeping
+// when that was first noticed.
+func markGone(h *orgHeading, when time.Time) {
+	kwd, title, tags := h.title()
+	if !contains(tags, "ARCHIVE") {
+		h.line = headingLine(h.level, kwd, title, append(tags, "ARCHIVE"))
+	}
+	if _, ok := h.property("GCALGONE"); !ok {
+		h.setProperty("GCALGONE", when.In(time.Local).Format("[2006-01-02 Mon 15:04]"))
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
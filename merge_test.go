@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeOrg(t *testing.T) {
+	inUTC(t)
+	deleted := map[string]time.Time{"b1": time.Date(2026, 10, 16, 18, 30, 0, 0, time.UTC)}
+	cals := map[string]exportedCalendar{
+		"me@x.com":   {tag: "WORK", fetched: true, deleted: deleted},
+		"team@x.com": {tag: "TEAM", fetched: true},
+	}
+	tests := []struct {
+		name string
+		old  string
+		new  string
+		cals map[string]exportedCalendar
+		want string
+	}{
+		{
+			name: "first export",
+			new: `#+category: cal
+* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+** Lunch
+:PROPERTIES:
+:ID:       a1
+:GCALLINK: l
+:END:
+
+<2026-10-17 Sat 12:00-13:00>
+`,
+			want: `#+category: cal
+* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+** Lunch
+:PROPERTIES:
+:ID:       a1
+:GCALLINK: l
+:GCALLINES: 2
+:END:
+
+<2026-10-17 Sat 12:00-13:00>
+`,
+		},
+		{
+			name: "edited event",
+			old: `#+category: cal
+#+startup: overview
+* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+** TODO [#A] Lunch :food:
+SCHEDULED: <2026-10-16 Fri>
+:PROPERTIES:
+:ID:       a1
+:GCALLINK: l
+:EFFORT:   1:00
+:GCALLINES: 4
+:END:
+:LOGBOOK:
+CLOCK: [2026-10-16 Fri 12:00]--[2026-10-16 Fri 12:30] =>  0:30
+:END:
+
+<2026-10-16 Fri 12:00-13:00>
+
+Summary: Lunch
+bring cash
+*** call Bob
+`,
+			new: `#+category: cal
+* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+** Lunch moved
+:PROPERTIES:
+:ID:       a1
+:GCALLINK: l
+:END:
+
+<2026-10-17 Sat 12:00-13:00>
+
+Summary: Lunch moved
+`,
+			want: `#+category: cal
+#+startup: overview
+* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+** TODO [#A] Lunch moved :food:
+SCHEDULED: <2026-10-16 Fri>
+:PROPERTIES:
+:ID:       a1
+:GCALLINK: l
+:GCALLINES: 4
+:EFFORT:   1:00
+:END:
+:LOGBOOK:
+CLOCK: [2026-10-16 Fri 12:00]--[2026-10-16 Fri 12:30] =>  0:30
+:END:
+
+<2026-10-17 Sat 12:00-13:00>
+
+Summary: Lunch moved
+bring cash
+*** call Bob
+`,
+		},
+		{
+			name: "deleted and out of the window",
+			old: `* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+** Lunch
+:PROPERTIES:
+:ID:       a1
+:GCALLINK: l
+:GCALLINES: 0
+:END:
+** Dentist
+:PROPERTIES:
+:ID:       b1
+:GCALLINK: l
+:GCALLINES: 1
+:END:
+<2026-10-10 Sat 10:00>
+bring the card
+** Standup
+:PROPERTIES:
+:ID:       c1
+:GCALLINK: l
+:GCALLINES: 1
+:END:
+<2026-10-10 Sat 09:00>
+`,
+			new: `* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+** Lunch
+:PROPERTIES:
+:ID:       a1
+:GCALLINK: l
+:END:
+`,
+			want: `* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+** Lunch
+:PROPERTIES:
+:ID:       a1
+:GCALLINK: l
+:GCALLINES: 0
+:END:
+** Dentist :ARCHIVE:
+:PROPERTIES:
+:ID:       b1
+:GCALLINK: l
+:GCALLINES: 1
+:GCALGONE: [2026-10-16 Fri 18:30]
+:END:
+<2026-10-10 Sat 10:00>
+bring the card
+** Standup
+:PROPERTIES:
+:ID:       c1
+:GCALLINK: l
+:GCALLINES: 1
+:END:
+<2026-10-10 Sat 09:00>
+`,
+		},
+		{
+			name: "failed calendar",
+			old: `* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+** Lunch
+:PROPERTIES:
+:ID:       a1
+:GCALLINK: l
+:GCALLINES: 0
+:END:
+* Team :TEAM:
+  :PROPERTIES:
+  :ID:         team@x.com
+  :END:
+
+** Standup
+:PROPERTIES:
+:ID:       c1
+:GCALLINK: l
+:GCALLINES: 1
+:END:
+<2026-10-10 Sat 09:00>
+`,
+			new: `* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+** Lunch
+:PROPERTIES:
+:ID:       a1
+:GCALLINK: l
+:END:
+* ERROR work/team@x.com
+  no network
+`,
+			cals: map[string]exportedCalendar{
+				"me@x.com":   {tag: "WORK", fetched: true},
+				"team@x.com": {tag: "TEAM"},
+			},
+			want: `* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+** Lunch
+:PROPERTIES:
+:ID:       a1
+:GCALLINK: l
+:GCALLINES: 0
+:END:
+* ERROR work/team@x.com
+  no network
+* Team :TEAM:
+  :PROPERTIES:
+  :ID:         team@x.com
+  :END:
+
+** Standup
+:PROPERTIES:
+:ID:       c1
+:GCALLINK: l
+:GCALLINES: 1
+:END:
+<2026-10-10 Sat 09:00>
+`,
+		},
+		{
+			name: "headings of the user",
+			old: `* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+** Dentist <2026-10-22 Thu 10:00>
+** Project
+:PROPERTIES:
+:ID:       5f1c-org-id
+:END:
+* Journal
+:PROPERTIES:
+:ID:       9a2e-org-id
+:END:
+** 2026-10-17 Saturday
+rainy
+`,
+			new: `* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+`,
+			want: `* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+** Dentist <2026-10-22 Thu 10:00>
+** Project
+:PROPERTIES:
+:ID:       5f1c-org-id
+:END:
+* Journal
+:PROPERTIES:
+:ID:       9a2e-org-id
+:END:
+** 2026-10-17 Saturday
+rainy
+`,
+		},
+		{
+			name: "legacy heading",
+			old: `* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+** Lunch
+:PROPERTIES:
+:ID:       a1
+:GCALLINK: l
+:END:
+
+<2026-10-16 Fri 12:00-13:00>
+bring cash
+`,
+			new: `* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+** Lunch
+:PROPERTIES:
+:ID:       a1
+:GCALLINK: l
+:END:
+
+<2026-10-17 Sat 12:00-13:00>
+`,
+			want: `* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+** Lunch
+:PROPERTIES:
+:ID:       a1
+:GCALLINK: l
+:GCALLINES: 2
+:END:
+
+<2026-10-17 Sat 12:00-13:00>
+
+<2026-10-16 Fri 12:00-13:00>
+bring cash
+`,
+		},
+		{
+			name: "datetree",
+			old: `* 2026
+** 2026-10 October
+*** 2026-10-16 Friday
+**** Lunch :WORK:
+:PROPERTIES:
+:ID:       a1
+:CALENDAR: me@x.com
+:GCALLINK: l
+:GCALLINES: 0
+:END:
+***** notes
+*** 2026-10-17 Saturday
+**** Standup :WORK:
+:PROPERTIES:
+:ID:       c1
+:CALENDAR: me@x.com
+:GCALLINK: l
+:GCALLINES: 0
+:END:
+`,
+			new: `* 2026
+** 2026-10 October
+*** 2026-10-17 Saturday
+**** Lunch :WORK:
+:PROPERTIES:
+:ID:       a1
+:CALENDAR: me@x.com
+:GCALLINK: l
+:END:
+`,
+			want: `* 2026
+** 2026-10 October
+*** 2026-10-17 Saturday
+**** Lunch :WORK:
+:PROPERTIES:
+:ID:       a1
+:CALENDAR: me@x.com
+:GCALLINK: l
+:GCALLINES: 0
+:END:
+***** notes
+**** Standup :WORK:
+:PROPERTIES:
+:ID:       c1
+:CALENDAR: me@x.com
+:GCALLINK: l
+:GCALLINES: 0
+:END:
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old, err := parseOrg(strings.NewReader(tt.old))
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := parseOrg(strings.NewReader(tt.new))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.cals == nil {
+				tt.cals = cals
+			}
+			mergeOrg(old, f, tt.cals)
+			var buf bytes.Buffer
+			if err := f.write(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("merged\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// orgFile is a parsed org file. Writing it back out gives the same bytes
+// that were parsed, plus whatever was changed.
+type orgFile struct {
+	preamble []string
+	headings []*orgHeading
+}
+
+// orgHeading is a heading, the lines of its section up to the next heading,
+// and its subheadings.
+type orgHeading struct {
+	level    int
+	line     string
+	lines    []string
+	parent   *orgHeading
+	children []*orgHeading
+}
+
+var headingRE = regexp.MustCompile(`^(\*+) `)
+
+// parseOrg reads an org file.
+func parseOrg(r io.Reader) (*orgFile, error) {
+	f := &orgFile{}
+	var stack []*orgHeading
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		m := headingRE.FindStringSubmatch(line)
+		if m == nil {
+			if len(stack) == 0 {
+				f.preamble = append(f.preamble, line)
+			} else {
+				h := stack[len(stack)-1]
+				h.lines = append(h.lines, line)
+			}
+			continue
+		}
+
+		h := &orgHeading{level: len(m[1]), line: line}
+		for len(stack) > 0 && stack[len(stack)-1].level >= h.level {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			f.headings = append(f.headings, h)
+		} else {
+			h.parent = stack[len(stack)-1]
+			h.parent.children = append(h.parent.children, h)
+		}
+		stack = append(stack, h)
+	}
+	return f, sc.Err()
+}
+
+func (f *orgFile) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, l := range f.preamble {
+		bw.WriteString(l + "\n")
+	}
+	for _, h := range f.headings {
+		h.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (h *orgHeading) write(w *bufio.Writer) {
+	w.WriteString(h.line + "\n")
+	for _, l := range h.lines {
+		w.WriteString(l + "\n")
+	}
+	for _, c := range h.children {
+		c.write(w)
+	}
+}
+
+// walk calls fn on every heading of the file, parents before children.
+func (f *orgFile) walk(fn func(*orgHeading)) {
+	var visit func([]*orgHeading)
+	visit = func(hs []*orgHeading) {
+		for _, h := range hs {
+			fn(h)
+			visit(h.children)
+		}
+	}
+	visit(f.headings)
+}
+
+// orgTodoKwds are the todo keywords org might put in front of a title, see
+// noTodoKwds.
+var orgTodoKwds = []string{"TODO", "NEXT", "STARTED", "WAITING", "PROJECT", "DONE", "NVM"}
+
+var tagsRE = regexp.MustCompile(`\s+(:[^\s:]+(?::[^\s:]+)*:)\s*$`)
+
+// title splits the heading line into its todo keyword, title and tags.
+func (h *orgHeading) title() (kwd, title string, tags []string) {
+	title = strings.TrimSpace(h.line[h.level:])
+	for _, k := range orgTodoKwds {
+		if title == k || strings.HasPrefix(title, k+" ") {
+			kwd = k
+			title = strings.TrimSpace(title[len(k):])
+			break
+		}
+	}
+	if m := tagsRE.FindStringSubmatchIndex(title); m != nil {
+		tags = strings.Split(strings.Trim(title[m[2]:m[3]], ":"), ":")
+		title = title[:m[0]]
+	}
+	return kwd, title, tags
+}
+
+// drawer returns the index of the :PROPERTIES: line and of its :END: line,
+// or -1s if the heading has no property drawer.
+func (h *orgHeading) drawer() (start, end int) {
+	for i, l := range h.lines {
+		t := strings.TrimSpace(l)
+		if t == "" {
+			continue
+		}
+		if t != ":PROPERTIES:" {
+			// The drawer has to come first, after any planning line.
+			if strings.HasPrefix(t, "SCHEDULED:") || strings.HasPrefix(t, "DEADLINE:") ||
+				strings.HasPrefix(t, "CLOSED:") {
+				continue
+			}
+			return -1, -1
+		}
+		for j := i + 1; j < len(h.lines); j++ {
+			if strings.TrimSpace(h.lines[j]) == ":END:" {
+				return i, j
+			}
+		}
+		return -1, -1
+	}
+	return -1, -1
+}
+
+// property returns the value of the named property of the heading.
+func (h *orgHeading) property(name string) (string, bool) {
+	start, end := h.drawer()
+	if start < 0 {
+		return "", false
+	}
+	prefix := ":" + strings.ToUpper(name) + ":"
+	for _, l := range h.lines[start+1 : end] {
+		t := strings.TrimSpace(l)
+		if strings.HasPrefix(strings.ToUpper(t), prefix) {
+			return strings.TrimSpace(t[len(prefix):]), true
+		}
+	}
+	return "", false
+}
+
+// setProperty sets the named property, adding a property drawer if the
+// heading has none.
+func (h *orgHeading) setProperty(name, value string) {
+	line := ":" + strings.ToUpper(name) + ": " + value
+	start, end := h.drawer()
+	if start < 0 {
+		h.lines = append([]string{":PROPERTIES:", line, ":END:"}, h.lines...)
+		return
+	}
+	prefix := ":" + strings.ToUpper(name) + ":"
+	for i := start + 1; i < end; i++ {
+		if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(h.lines[i])), prefix) {
+			h.lines[i] = line
+			return
+		}
+	}
+	h.lines = append(h.lines[:end], append([]string{line}, h.lines[end:]...)...)
+}
+
+// deleteProperty removes the property name from the drawer of h.
+func (h *orgHeading) deleteProperty(name string) {
+	start, end := h.drawer()
+	prefix := ":" + strings.ToUpper(name) + ":"
+	for i := start + 1; i < end; i++ {
+		if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(h.lines[i])), prefix) {
+			h.lines = append(h.lines[:i], h.lines[i+1:]...)
+			return
+		}
+	}
+}
+
+// body returns the section lines after the property drawer.
+func (h *orgHeading) body() []string {
+	_, end := h.drawer()
+	return h.lines[end+1:]
+}
+
+// calendarID returns the id of the calendar the event heading h came from:
+// its :CALENDAR: property, or else the :ID: of the heading it's under.
+func (h *orgHeading) calendarID() string {
+	if id, ok := h.property("CALENDAR"); ok {
+		return id
+	}
+	for p := h.parent; p != nil; p = p.parent {
+		if id, ok := p.property("ID"); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+// eventSections is the section of an exported event heading, taken apart to
+// tell what gcalorg wrote from what was added to it since.
+type eventSections struct {
+	// planning is what comes before the property drawer, like SCHEDULED.
+	planning []string
+	drawer   []string
+
+	// drawers are the ones org puts right after the property drawer, like
+	// LOGBOOK.
+	drawers []string
+
+	// generated is the text gcalorg wrote, :GCALLINES: lines of it, and
+	// notes everything after. Without :GCALLINES: all of it is generated.
+	generated []string
+	notes     []string
+}
+
+var drawerStartRE = regexp.MustCompile(`^:[\w-]+:$`)
+
+func (h *orgHeading) sections() eventSections {
+	var s eventSections
+	start, end := h.drawer()
+	if start >= 0 {
+		s.planning, s.drawer = h.lines[:start], h.lines[start:end+1]
+	}
+	rest := h.lines[end+1:]
+	for len(rest) > 0 && drawerStartRE.MatchString(strings.TrimSpace(rest[0])) {
+		i := 1
+		for i < len(rest) && strings.TrimSpace(rest[i]) != ":END:" {
+			i++
+		}
+		if i == len(rest) {
+			break
+		}
+		s.drawers = append(s.drawers, rest[:i+1]...)
+		rest = rest[i+1:]
+	}
+
+	s.generated = rest
+	if v, ok := h.property("GCALLINES"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 && n < len(rest) {
+			s.generated, s.notes = rest[:n], rest[n:]
+		}
+	}
+	return s
+}
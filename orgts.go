@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// orgTimestampRE matches one active or inactive org timestamp, e.g.
+// <2026-10-17 Sat 10:00-11:30 +1w>.
+var orgTimestampRE = regexp.MustCompile(
+	`[<\[](\d{4}-\d{2}-\d{2})(?: [^\s\d>\]]+)?(?: (\d{1,2}:\d{2})(?:-(\d{1,2}:\d{2}))?)?(?: ([.+]?\+\d+[hdwmy]))?[>\]]`)
+
+// activeTimestampRE matches an active timestamp or range anywhere in a line.
+var activeTimestampRE = regexp.MustCompile(`<\d{4}-\d{2}-\d{2}[^>\n]*>(?:--<\d{4}-\d{2}-\d{2}[^>\n]*>)?`)
+
+// findActiveTimestamp returns the first active timestamp or range in line.
+func findActiveTimestamp(line string) (string, bool) {
+	ts := activeTimestampRE.FindString(line)
+	return ts, ts != ""
+}
+
+// orgRepeaterRule turns the repeater of an org timestamp into an RRULE. ok is
+// false if the timestamp doesn't repeat.
+func orgRepeaterRule(ts string) (rule string, ok bool, err error) {
+	m := orgTimestampRE.FindStringSubmatch(ts)
+	if m == nil || m[4] == "" {
+		return "", false, nil
+	}
+	cookie := strings.TrimLeft(m[4], ".+")
+	n, unit := cookie[:len(cookie)-1], cookie[len(cookie)-1]
+	freq := map[byte]string{'d': "DAILY", 'w': "WEEKLY", 'm': "MONTHLY", 'y': "YEARLY"}[unit]
+	if freq == "" {
+		return "", false, fmt.Errorf("can't repeat every %s in google calendar", m[4])
+	}
+	return fmt.Sprintf("RRULE:FREQ=%s;INTERVAL=%s", freq, n), true, nil
+}
+
+// isOrgTimestampLine reports whether line is one of the timestamp lines
+// fmtDates writes.
+func isOrgTimestampLine(line string) bool {
+	m := orgTimestampRE.FindStringIndex(line)
+	return m != nil && m[0] == 0
+}
+
+// parseOrgTimestamp parses an org timestamp or range the way datesToOrg
+// writes them back into event times. end is nil if the timestamp has none.
+func parseOrgTimestamp(s string) (start, end *calendar.EventDateTime, err error) {
+	s = strings.TrimSpace(s)
+	ms := orgTimestampRE.FindAllStringSubmatchIndex(s, 2)
+	if len(ms) == 0 || ms[0][0] != 0 {
+		return nil, nil, fmt.Errorf("not an org timestamp: %q", s)
+	}
+	sub := func(m []int, i int) string {
+		if m[2*i] < 0 {
+			return ""
+		}
+		return s[m[2*i]:m[2*i+1]]
+	}
+	at := func(date, clock string) (*calendar.EventDateTime, time.Time, error) {
+		if clock == "" {
+			t, err := time.ParseInLocation("2006-01-02", date, time.Local)
+			return &calendar.EventDateTime{Date: date}, t, err
+		}
+		t, err := time.ParseInLocation("2006-01-02 15:04", date+" "+clock, time.Local)
+		return &calendar.EventDateTime{DateTime: t.Format(time.RFC3339)}, t, err
+	}
+
+	first := ms[0]
+	date, clock, endClock := sub(first, 1), sub(first, 2), sub(first, 3)
+	start, st, err := at(date, clock)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rest := s[first[1]:]
+	switch {
+	case len(ms) == 2 && strings.HasPrefix(rest, "--") && ms[1][0] == first[1]+2:
+		second := ms[1]
+		if sub(second, 3) != "" || (sub(second, 2) == "") != (clock == "") {
+			return nil, nil, fmt.Errorf("mismatched timestamp range: %q", s)
+		}
+		var et time.Time
+		end, et, err = at(sub(second, 1), sub(second, 2))
+		if err != nil {
+			return nil, nil, err
+		}
+		if clock == "" {
+			// All day ends are exclusive in the API.
+			et = et.AddDate(0, 0, 1)
+			end = &calendar.EventDateTime{Date: et.Format("2006-01-02")}
+		}
+		if !et.After(st) {
+			return nil, nil, fmt.Errorf("timestamp range ends before it starts: %q", s)
+		}
+	case strings.TrimSpace(rest) != "":
+		return nil, nil, fmt.Errorf("unexpected text after timestamp: %q", s)
+	case endClock != "":
+		var et time.Time
+		end, et, err = at(date, endClock)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !et.After(st) {
+			return nil, nil, fmt.Errorf("timestamp ends before it starts: %q", s)
+		}
+	case clock == "":
+		end = &calendar.EventDateTime{Date: st.AddDate(0, 0, 1).Format("2006-01-02")}
+	}
+	return start, end, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+func TestParseOrgTimestamp(t *testing.T) {
+	inUTC(t)
+	tests := []struct {
+		ts        string
+		wantStart calendar.EventDateTime
+		wantEnd   *calendar.EventDateTime
+		wantErr   bool
+	}{
+		{
+			ts:        "<2026-10-17 Sat>",
+			wantStart: calendar.EventDateTime{Date: "2026-10-17"},
+			wantEnd:   &calendar.EventDateTime{Date: "2026-10-18"},
+		},
+		{
+			ts:        "<2026-10-17 Sat 10:00>",
+			wantStart: calendar.EventDateTime{DateTime: "2026-10-17T10:00:00Z"},
+		},
+		{
+			ts:        "<2026-10-17 Sat 10:00-11:30>",
+			wantStart: calendar.EventDateTime{DateTime: "2026-10-17T10:00:00Z"},
+			wantEnd:   &calendar.EventDateTime{DateTime: "2026-10-17T11:30:00Z"},
+		},
+		{
+			ts:        "<2026-10-17 Sat 9:00-9:45 +1w>",
+			wantStart: calendar.EventDateTime{DateTime: "2026-10-17T09:00:00Z"},
+			wantEnd:   &calendar.EventDateTime{DateTime: "2026-10-17T09:45:00Z"},
+		},
+		{
+			ts:        "[2026-10-17 Sat 10:00]",
+			wantStart: calendar.EventDateTime{DateTime: "2026-10-17T10:00:00Z"},
+		},
+		{
+			ts:        "<2026-10-17 Sat>--<2026-10-19 Mon>",
+			wantStart: calendar.EventDateTime{Date: "2026-10-17"},
+			wantEnd:   &calendar.EventDateTime{Date: "2026-10-20"},
+		},
+		{
+			ts:        "<2026-10-17 Sat 22:00>--<2026-10-18 Sun 02:00>",
+			wantStart: calendar.EventDateTime{DateTime: "2026-10-17T22:00:00Z"},
+			wantEnd:   &calendar.EventDateTime{DateTime: "2026-10-18T02:00:00Z"},
+		},
+		{
+			ts:        "  <2026-10-17>  ",
+			wantStart: calendar.EventDateTime{Date: "2026-10-17"},
+			wantEnd:   &calendar.EventDateTime{Date: "2026-10-18"},
+		},
+		{ts: "<2026-10-17 Sat 11:00-10:00>", wantErr: true},
+		{ts: "<2026-10-19 Mon>--<2026-10-17 Sat>", wantErr: true},
+		{ts: "<2026-10-17 Sat 10:00>--<2026-10-18 Sun>", wantErr: true},
+		{ts: "<2026-10-17 Sat 10:00>--<2026-10-18 Sun 10:00-11:00>", wantErr: true},
+		{ts: "<2026-10-17 Sat> dentist", wantErr: true},
+		{ts: "<2026-13-01 Sat>", wantErr: true},
+		{ts: "dentist <2026-10-17 Sat>", wantErr: true},
+		{ts: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ts, func(t *testing.T) {
+			start, end, err := parseOrgTimestamp(tt.ts)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseOrgTimestamp(%q) = %+v, %+v, want an error", tt.ts, start, end)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseOrgTimestamp(%q): %v", tt.ts, err)
+			}
+			if !reflect.DeepEqual(*start, tt.wantStart) {
+				t.Errorf("start %+v, want %+v", *start, tt.wantStart)
+			}
+			if !reflect.DeepEqual(end, tt.wantEnd) {
+				t.Errorf("end %+v, want %+v", end, tt.wantEnd)
+			}
+		})
+	}
+}
@@ -0,0 +1,650 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+)
+
+var pushCmd = &command{
+	name:  "push",
+	args:  "[flags] <file.org>",
+	short: "send edits made in an exported org file back to google calendar",
+	long: `
+Push compares the event headings of an exported org file, found by their
+:ID: property, with the events they were exported from and sends the edited
+titles, timestamps and descriptions back with Events.Patch. Setting
+:RSVP: to accepted, declined or tentative on a heading answers the
+invitation, with :RSVP_COMMENT: as an optional comment; both are removed
+from the heading once the answer is sent.
+
+A new heading with an active timestamp under a calendar's heading becomes a
+new event in that calendar. Its text becomes the description, and a
+repeater (+1w) makes it recurring. Once created, the event's :ID: is
+written into the heading, so the next push updates it instead.
+
+By default it only shows what it would change. With --apply it writes the
+changes, refusing any event that was also changed in google calendar since
+the heading was exported, as its :ETAG: tells; re-export and redo the edit
+for those. Timestamps of recurring events aren't pushed. It takes the lock
+export --output takes on the file, and fails the same way while an export
+is writing it.
+
+Push reads headings the way the built-in event template writes them, so it
+refuses to run when the config sets an event template of its own.
+
+Push needs permission to change events. gcalorg asks for it the first time
+it's needed, or authorize it ahead of time with 'gcalorg auth --write'.
+`,
+	run: runPush,
+}
+
+// pushOp is a change push makes to one event.
+type pushOp struct {
+	acct    *account
+	calID   string
+	heading *orgHeading
+
+	// base is the cached event the heading was exported from, or nil if
+	// the heading is a new event.
+	base  *calendar.Event
+	cache *eventCache
+	path  string
+
+	// etag is the :ETAG: of the heading, the version of the event it was
+	// rendered from, which the patch must still apply to. base.Etag stands
+	// in for files exported before there was one.
+	etag string
+
+	patch   *calendar.Event
+	changes []string
+
+	// rsvp is set when the patch answers the :RSVP: of the heading.
+	rsvp bool
+
+	// applied is set once the change went through, and created once the
+	// new event of the heading was inserted.
+	applied bool
+	created bool
+}
+
+// title returns the title of the heading, or the summary of the event when
+// there's no heading.
+func (op *pushOp) title() string {
+	if op.heading == nil {
+		return op.base.Summary
+	}
+	_, title, _ := op.heading.title()
+	return title
+}
+
+func (op *pushOp) print(w io.Writer) {
+	title := op.title()
+	if op.base == nil {
+		fmt.Fprintf(w, "%s: %s (new event in %s)\n", op.acct.Name, title, op.calID)
+	} else {
+		fmt.Fprintf(w, "%s: %s (%s)\n", op.acct.Name, title, op.base.Id)
+	}
+	for _, c := range op.changes {
+		fmt.Fprintf(w, "  %s\n", strings.Replace(c, "\n", "\n  ", -1))
+	}
+}
+
+func runPush(cmd *command, args []string) error {
+	fs := cmd.flags()
+	configPath := configFlag(fs)
+	apply := fs.Bool("apply", false, "write the changes to google calendar instead of showing them")
+	if err := cmd.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return usageError(fmt.Errorf("expected one org file"))
+	}
+
+	conf, err := loadConfig(*configPath)
+	if err != nil {
+		return configError(err)
+	}
+	if conf.Templates.Event != "" {
+		// Titles and descriptions would be misread and patched back.
+		return configError(fmt.Errorf("%s: push only reads event headings written by the built-in "+
+			"event template, remove event from [templates] to push", conf.path))
+	}
+	path := fs.Arg(0)
+	if *apply {
+		// Held until the ids of new events are written back, so an
+		// export can't replace the file in between.
+		unlock, err := lockOutput(path)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	f, err := readOrgFile(path)
+	if err != nil {
+		return err
+	}
+
+	ops, err := planPush(conf, f)
+	if err != nil {
+		return err
+	}
+	if len(ops) == 0 {
+		fmt.Fprintf(os.Stderr, "nothing to push\n")
+		return nil
+	}
+	for _, op := range ops {
+		op.print(os.Stdout)
+	}
+	if !*apply {
+		fmt.Fprintf(os.Stderr, "dry run, rerun with --apply to push %d change(s)\n", len(ops))
+		return nil
+	}
+	err = applyPush(ops)
+
+	// The ids of new events are in the file now, even if other changes
+	// failed.
+	if settleHeadings(ops) {
+		if werr := writeOrgFile(path, f); werr != nil {
+			return fmt.Errorf("pushed changes but couldn't write them back to %s: %w", path, werr)
+		}
+	}
+	return err
+}
+
+// settleHeadings drops the :RSVP: of headings whose answer was sent, so the
+// next push doesn't answer again after the response was changed elsewhere.
+// It reports whether that or inserting events changed any heading.
+func settleHeadings(ops []*pushOp) (changed bool) {
+	for _, op := range ops {
+		if op.applied && op.rsvp {
+			op.heading.deleteProperty("RSVP")
+			op.heading.deleteProperty("RSVP_COMMENT")
+			changed = true
+		}
+		changed = changed || op.created
+	}
+	return changed
+}
+
+// writeOrgFile atomically replaces the org file at path with f, keeping its
+// permissions.
+func writeOrgFile(path string, f *orgFile) error {
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	var buf bytes.Buffer
+	if err := f.write(&buf); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf.Bytes(), perm)
+}
+
+func readOrgFile(path string) (*orgFile, error) {
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	f, err := parseOrg(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+// calendarOwner is the configured account and calendar a calendar id
+// belongs to.
+type calendarOwner struct {
+	acct *account
+	cal  *calendarConfig
+}
+
+func (c *config) calendarOwners() map[string]calendarOwner {
+	owners := make(map[string]calendarOwner)
+	for _, a := range c.Accounts {
+		for _, cal := range a.Calendars {
+			if _, ok := owners[cal.ID]; !ok {
+				owners[cal.ID] = calendarOwner{a, cal}
+			}
+		}
+	}
+	return owners
+}
+
+// planPush finds the event headings of f that were edited since the export.
+func planPush(conf *config, f *orgFile) ([]*pushOp, error) {
+	owners := conf.calendarOwners()
+	type cacheKey struct{ acct, cal string }
+	caches := make(map[cacheKey]*eventCache)
+	paths := make(map[cacheKey]string)
+
+	var ops []*pushOp
+	var err error
+	f.walk(func(h *orgHeading) {
+		if err != nil {
+			return
+		}
+		owner, ok := owners[h.calendarID()]
+		if !ok {
+			return
+		}
+
+		key := cacheKey{owner.acct.Name, owner.cal.ID}
+		cache, ok := caches[key]
+		if !ok {
+			var path string
+			path, err = eventCachePath(owner.acct, owner.cal.ID)
+			if err != nil {
+				return
+			}
+			cache = loadEventCache(path, owner.cal.ID)
+			caches[key], paths[key] = cache, path
+		}
+
+		uid, ok := h.property("ID")
+		if !ok {
+			var op *pushOp
+			if op, err = planInsert(h, owner.acct, owner.cal.ID); op != nil {
+				op.cache, op.path = cache, paths[key]
+				ops = append(ops, op)
+			}
+			return
+		}
+		if _, gone := h.property("GCALGONE"); gone {
+			return
+		}
+		base := cache.findEvent(uid)
+		if base == nil {
+			_, title, _ := h.title()
+			fmt.Fprintf(os.Stderr, "%s: %q isn't in the event cache, export again first\n",
+				owner.acct.Name, title)
+			return
+		}
+		op := diffHeading(h, base)
+		if len(op.changes) == 0 {
+			return
+		}
+		op.acct, op.calID = owner.acct, owner.cal.ID
+		op.cache, op.path = cache, paths[key]
+		ops = append(ops, op)
+	})
+	return ops, err
+}
+
+// findEvent returns the cached event with the iCalendar uid, preferring the
+// master of a recurring event over its occurrences.
+func (c *eventCache) findEvent(uid string) *calendar.Event {
+	var found *calendar.Event
+	for _, e := range c.Events {
+		if e.ICalUID != uid {
+			continue
+		}
+		if e.RecurringEventId == "" {
+			return e
+		}
+		found = e
+	}
+	if found != nil {
+		if master, ok := c.Events[found.RecurringEventId]; ok {
+			return master
+		}
+	}
+	return found
+}
+
+// planInsert returns the op creating an event from the new heading h, or nil
+// if h has no active timestamp.
+func planInsert(h *orgHeading, acct *account, calID string) (*pushOp, error) {
+	_, title, _ := h.title()
+	ts, ok := findActiveTimestamp(title)
+	var desc []string
+	for _, l := range h.body() {
+		if !ok {
+			if ts, ok = findActiveTimestamp(l); ok {
+				continue
+			}
+		}
+		desc = append(desc, l)
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	summary := strings.TrimSpace(strings.Replace(title, ts, "", 1))
+	start, end, err := parseOrgTimestamp(ts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%q: %v, not creating it\n", title, err)
+		return nil, nil
+	}
+	if end == nil {
+		end = shiftTime(start, defaultEventLength)
+	}
+	id, err := newEventID()
+	if err != nil {
+		return nil, err
+	}
+	e := &calendar.Event{
+		Id:          id,
+		Summary:     summary,
+		Description: strings.TrimSpace(strings.Join(desc, "\n")),
+		Start:       start,
+		End:         end,
+	}
+	changes := []string{"time: " + datesToOrg(start, end)}
+
+	rule, repeats, err := orgRepeaterRule(ts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%q: %v, not creating it\n", title, err)
+		return nil, nil
+	}
+	if repeats {
+		tz, err := calendarTimeZone(acct, calID)
+		if err != nil {
+			return nil, err
+		}
+		e.Recurrence = []string{rule}
+		e.Start.TimeZone, e.End.TimeZone = tz, tz
+		changes = append(changes, "repeats: "+rule)
+	}
+	if e.Description != "" {
+		changes = append(changes, "description:\n"+prefixLines(e.Description, "  +"))
+	}
+	return &pushOp{acct: acct, calID: calID, heading: h, patch: e, changes: changes}, nil
+}
+
+// defaultEventLength is how long a new event given only a start time lasts.
+const defaultEventLength = time.Hour
+
+// calendarTimeZone returns the time zone of a calendar from the cached
+// calendar list, as recurring events need one.
+func calendarTimeZone(acct *account, calID string) (string, error) {
+	list, err := loadCalendarList(acct)
+	if err != nil {
+		return "", fmt.Errorf("no cached calendar list to find the time zone of %s in, export first: %w", calID, err)
+	}
+	for _, c := range list.Calendars {
+		if c.Id == calID && c.TimeZone != "" {
+			return c.TimeZone, nil
+		}
+	}
+	return "", fmt.Errorf("calendar %s isn't in the cached calendar list, export first", calID)
+}
+
+// newEventID returns a random event id. Inserting with an id of our own makes
+// a retried insert fail with 409 instead of creating the event twice.
+func newEventID() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// Event ids take the base32hex alphabet, lower case.
+	return strings.ToLower(base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(b)), nil
+}
+
+// applyInsert creates the event of a new heading and records its id in the
+// heading.
+func applyInsert(srv *calendar.Service, op *pushOp) error {
+	created, err := srv.Events.Insert(op.calID, op.patch).Do()
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == 409 && op.patch.Id != "" {
+		// A retry of an insert that went through after all.
+		created, err = srv.Events.Get(op.calID, op.patch.Id).Do()
+	}
+	if err != nil {
+		return apiError(err)
+	}
+	op.heading.setProperty("ID", created.ICalUID)
+	op.heading.setProperty("GCALLINK", created.HtmlLink)
+	op.cache.Events[created.Id] = created
+	op.created = true
+	return nil
+}
+
+// headingSummary undoes what the built-in event template does to an event
+// summary.
+func headingSummary(title string) string {
+	if ts, ok := findActiveTimestamp(title); ok {
+		// Left there by a heading that was pushed as a new event.
+		title = strings.TrimSpace(strings.Replace(title, ts, "", 1))
+	}
+	title = strings.TrimPrefix(title, priorityRE.FindString(title))
+	// Older exports misspelled tentative.
+	for _, status := range []string{"(tentative) ", "(cancelled) ", "(tenative) "} {
+		title = strings.TrimPrefix(title, status)
+	}
+	for _, k := range orgTodoKwds {
+		if strings.HasPrefix(title, "/"+k+"/ ") {
+			return k + title[len(k)+2:]
+		}
+	}
+	return title
+}
+
+// headingDescription returns the description fmtOrgBody wrote into body,
+// with the "Summary:" line and attachments left out.
+func headingDescription(body []string) (string, bool) {
+	for i, l := range body {
+		if !strings.HasPrefix(l, "Summary: ") {
+			continue
+		}
+		var desc []string
+		for _, l := range body[i+1:] {
+			if l == "Attachments:" || strings.HasPrefix(l, "Summary: ") {
+				break
+			}
+			desc = append(desc, l)
+		}
+		return strings.TrimRight(strings.Join(desc, "\n"), "\n "), true
+	}
+	return "", false
+}
+
+// escapeDescriptionLine escapes a line of a description the way cleanString
+// does when it exports it.
+func escapeDescriptionLine(l string) string {
+	l = strings.NewReplacer("[", "{", "]", "}").Replace(l)
+	if strings.HasPrefix(l, "*") {
+		l = "," + l
+	}
+	return l
+}
+
+// restoreDescription turns the description desc of a heading back into the
+// text of the event, undoing what cleanString did to raw, the description it
+// was exported from. Lines that weren't edited get their raw text back.
+// Braces in edited lines only become brackets again if raw had brackets but
+// no braces, so they can't have been typed as braces.
+func restoreDescription(desc, raw string) string {
+	rawLines := make(map[string]string)
+	for _, l := range strings.Split(raw, "\n") {
+		rawLines[escapeDescriptionLine(l)] = l
+	}
+	brackets := strings.ContainsAny(raw, "[]") && !strings.ContainsAny(raw, "{}")
+	lines := strings.Split(desc, "\n")
+	for i, l := range lines {
+		if r, ok := rawLines[l]; ok {
+			lines[i] = r
+			continue
+		}
+		if strings.HasPrefix(l, ",*") {
+			l = l[1:]
+		}
+		if brackets {
+			l = strings.NewReplacer("{", "[", "}", "]").Replace(l)
+		}
+		lines[i] = l
+	}
+	return strings.Join(lines, "\n")
+}
+
+// diffHeading compares an event heading with the event it was exported from
+// and returns the patch that makes the event match it.
+func diffHeading(h *orgHeading, base *calendar.Event) *pushOp {
+	op := &pushOp{heading: h, base: base, etag: base.Etag, patch: &calendar.Event{}}
+	if etag, ok := h.property("ETAG"); ok && etag != "" {
+		op.etag = etag
+	}
+	// Notes written after the text of a merged export aren't the
+	// description.
+	body := h.sections().generated
+
+	_, title, _ := h.title()
+	summary := headingSummary(title)
+	if summary != base.Summary && !(base.Summary == "" && summary == "busy") {
+		op.patch.Summary = summary
+		op.changes = append(op.changes, fmt.Sprintf("summary: %q -> %q", base.Summary, summary))
+	}
+
+	var ts string
+	for _, l := range body {
+		if isOrgTimestampLine(l) {
+			ts = l
+			break
+		}
+	}
+	if ts != "" && len(base.Recurrence) == 0 && base.RecurringEventId == "" && base.Start != nil {
+		start, end, err := parseOrgTimestamp(ts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%q: %v\n", title, err)
+		} else {
+			if end == nil {
+				end = shiftTime(start, eventEnd(base).Sub(eventStart(base)))
+			}
+			if start.DateTime != "" {
+				start.TimeZone, end.TimeZone = base.Start.TimeZone, base.Start.TimeZone
+			}
+			was, now := datesToOrg(base.Start, base.End), datesToOrg(start, end)
+			if was != now {
+				op.patch.Start, op.patch.End = start, end
+				op.changes = append(op.changes, fmt.Sprintf("time: %s -> %s", was, now))
+			}
+		}
+	} else if ts != "" {
+		want := strings.SplitN(fmtDates(base, datesToOrg), "\n", 2)[0]
+		if normalizeTimestamp(ts) != normalizeTimestamp(want) {
+			fmt.Fprintf(os.Stderr, "%q: timestamps of recurring events can't be pushed, ignoring\n", title)
+		}
+	}
+
+	if desc, ok := headingDescription(body); ok {
+		was := strings.TrimRight(base.Description, "\n ")
+		if desc = restoreDescription(desc, base.Description); desc != was {
+			op.patch.Description = desc
+			op.patch.ForceSendFields = append(op.patch.ForceSendFields, "Description")
+			op.changes = append(op.changes, "description:\n"+lineDiff(was, desc))
+		}
+	}
+	if status, ok := h.property("RSVP"); ok && status != "" {
+		comment, _ := h.property("RSVP_COMMENT")
+		attendees, change, err := rsvpPatch(base, status, comment)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%q: %v\n", title, err)
+		} else if attendees != nil {
+			op.patch.Attendees = attendees
+			op.changes = append(op.changes, change)
+			op.rsvp = true
+		}
+	}
+	return op
+}
+
+// shiftTime returns dt moved forward by d.
+func shiftTime(dt *calendar.EventDateTime, d time.Duration) *calendar.EventDateTime {
+	if dt.Date != "" {
+		return shiftDate(dt, int(d.Hours()/24+0.5))
+	}
+	t, _ := time.Parse(time.RFC3339, dt.DateTime)
+	return &calendar.EventDateTime{DateTime: t.Add(d).Format(time.RFC3339), TimeZone: dt.TimeZone}
+}
+
+// normalizeTimestamp makes inactive timestamps active, so declining an
+// event doesn't count as moving it.
+func normalizeTimestamp(ts string) string {
+	ts = strings.Replace(ts, "[", "<", -1)
+	return strings.TrimSpace(strings.Replace(ts, "]", ">", -1))
+}
+
+// lineDiff shows the old and new text, prefixing lines with - and +.
+func lineDiff(was, now string) string {
+	return prefixLines(was, "  -") + "\n" + prefixLines(now, "  +")
+}
+
+func prefixLines(s, prefix string) string {
+	return prefix + strings.Replace(s, "\n", "\n"+prefix, -1)
+}
+
+// applyPush patches the events, skipping those changed in google calendar
+// since they were exported.
+func applyPush(ops []*pushOp) error {
+	services := make(map[string]*calendar.Service)
+	failed := 0
+	for _, op := range ops {
+		srv, ok := services[op.acct.Name]
+		if !ok {
+			client, err := genClient(op.acct, writeScope)
+			if err != nil {
+				return fmt.Errorf("%s: %w", op.acct.Name, err)
+			}
+			if srv, err = calendar.New(client); err != nil {
+				return apiError(fmt.Errorf("%s: unable to create calendar client: %w", op.acct.Name, err))
+			}
+			services[op.acct.Name] = srv
+		}
+
+		apply := applyOp
+		if op.base == nil {
+			apply = applyInsert
+		}
+		if err := apply(srv, op); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %q: %v\n", op.acct.Name, op.title(), err)
+			failed++
+			continue
+		}
+		op.applied = true
+		if err := op.cache.save(op.path); err != nil {
+			return fmt.Errorf("unable to save event cache: %w", err)
+		}
+	}
+	if failed > 0 {
+		return apiError(fmt.Errorf("%d of %d change(s) not pushed", failed, len(ops)))
+	}
+	fmt.Fprintf(os.Stderr, "pushed %d change(s)\n", len(ops))
+	return nil
+}
+
+var errConflict = errors.New("changed in google calendar since the export; export again and redo the edit")
+
+func applyOp(srv *calendar.Service, op *pushOp) error {
+	current, err := srv.Events.Get(op.calID, op.base.Id).Do()
+	if err != nil {
+		return apiError(err)
+	}
+	if current.Etag != op.etag {
+		return fmt.Errorf("%w (updated %s)", errConflict, current.Updated)
+	}
+
+	call := srv.Events.Patch(op.calID, op.base.Id, op.patch)
+	call.Header().Set("If-Match", op.etag)
+	updated, err := call.Do()
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == 412 {
+		return errConflict
+	}
+	if err != nil {
+		return apiError(err)
+	}
+	op.cache.Events[updated.Id] = updated
+	return nil
+}
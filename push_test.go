@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+func TestRestoreDescription(t *testing.T) {
+	tests := []struct {
+		name string
+		desc string
+		raw  string
+		want string
+	}{
+		{
+			name: "untouched",
+			desc: "see {{https://x.com}{doc}}\n,* notes",
+			raw:  "see [[https://x.com][doc]]\n* notes",
+			want: "see [[https://x.com][doc]]\n* notes",
+		},
+		{
+			name: "edited line with brackets",
+			desc: "see {{https://x.com}{the doc}}\nbring snacks",
+			raw:  "see [[https://x.com][doc]]",
+			want: "see [[https://x.com][the doc]]\nbring snacks",
+		},
+		{
+			name: "braces typed",
+			desc: "a {b}\nnew {c}",
+			raw:  "a {b}",
+			want: "a {b}\nnew {c}",
+		},
+		{
+			name: "mixed raw keeps braces",
+			desc: "{x} and {y} edited",
+			raw:  "[x] and {y}",
+			want: "{x} and {y} edited",
+		},
+		{
+			name: "new heading line",
+			desc: "intro\n,* item",
+			raw:  "intro",
+			want: "intro\n* item",
+		},
+		{
+			name: "empty",
+			desc: "",
+			raw:  "",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := restoreDescription(tt.desc, tt.raw); got != tt.want {
+				t.Errorf("restoreDescription(%q, %q) = %q, want %q", tt.desc, tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeEvents serves Events.Get and Events.Patch of one event, like the API
+// does: patches need the event's current etag in If-Match, and change it.
+type fakeEvents struct {
+	mu      sync.Mutex
+	event   *calendar.Event
+	patches int
+}
+
+func (f *fakeEvents) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !strings.HasSuffix(r.URL.Path, "/events/"+f.event.Id) {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "PATCH":
+		if r.Header.Get("If-Match") != f.event.Etag {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			w.Write([]byte(`{"error":{"code":412,"message":"Precondition Failed"}}`))
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		patched := *f.event
+		if err := json.Unmarshal(b, &patched); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.patches++
+		patched.Etag = `"` + strings.Repeat("1", f.patches) + `"`
+		f.event = &patched
+	default:
+		http.Error(w, "unexpected method", http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(f.event)
+}
+
+// fakeService returns a calendar service talking to h.
+func fakeService(t *testing.T, h http.Handler) *calendar.Service {
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	srv, err := calendar.New(ts.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.BasePath = ts.URL + "/"
+	return srv
+}
+
+func TestRespond(t *testing.T) {
+	invite := func(etag string) *calendar.Event {
+		return &calendar.Event{
+			Id: "e1", ICalUID: "e1@google.com", Etag: etag, Summary: "Review",
+			Attendees: []*calendar.EventAttendee{
+				{Email: "boss@x.com", Organizer: true, ResponseStatus: "accepted"},
+				{Email: "me@x.com", Self: true, ResponseStatus: "needsAction"},
+			},
+		}
+	}
+	tests := []struct {
+		name       string
+		cached     string // etag of the cached event
+		server     string // etag of the event in google calendar
+		wantErr    error
+		wantStatus string
+	}{
+		{name: "answered", cached: `"0"`, server: `"0"`, wantStatus: "declined"},
+		{name: "changed since", cached: `"0"`, server: `"5"`, wantErr: errConflict, wantStatus: "needsAction"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_CACHE_HOME", t.TempDir())
+			cal := &calendarConfig{ID: "me@x.com"}
+			acct := &account{Name: "work", Calendars: []*calendarConfig{cal}}
+			path, err := eventCachePath(acct, cal.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cache := loadEventCache(path, cal.ID)
+			cache.Events["e1"] = invite(tt.cached)
+			if err := cache.save(path); err != nil {
+				t.Fatal(err)
+			}
+			fake := &fakeEvents{event: invite(tt.server)}
+			srv := fakeService(t, fake)
+
+			op, err := findRespondTarget([]*account{acct}, "", "e1@google.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			attendees, _, err := rsvpPatch(op.base, "declined", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			op.patch = &calendar.Event{Attendees: attendees}
+			if err := applyOp(srv, op); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("applyOp: %v, want %v", err, tt.wantErr)
+			}
+			if got := selfAttendee(fake.event).ResponseStatus; got != tt.wantStatus {
+				t.Errorf("response %q, want %q", got, tt.wantStatus)
+			}
+			if tt.wantErr == nil && op.cache.Events["e1"].Etag != fake.event.Etag {
+				t.Errorf("cached etag %s, want %s", op.cache.Events["e1"].Etag, fake.event.Etag)
+			}
+		})
+	}
+}
+
+func TestApplyOpEtag(t *testing.T) {
+	const heading = `** Review
+:PROPERTIES:
+:ID:       e1@google.com
+:GCALLINK: l
+:ETAG:     %s
+:END:
+
+Summary: Review
+%s
+`
+	tests := []struct {
+		name        string
+		headingEtag string
+		wantErr     error
+	}{
+		{name: "exported from the current version", headingEtag: `"1"`},
+		{name: "exported from an older version", headingEtag: `"0"`, wantErr: errConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The cache already has the newer version, the heading
+			// doesn't.
+			base := &calendar.Event{Id: "e1", ICalUID: "e1@google.com", Etag: `"1"`,
+				Summary: "Review", Description: "agenda"}
+			fake := &fakeEvents{event: base}
+			srv := fakeService(t, fake)
+
+			f, err := parseOrg(strings.NewReader(fmt.Sprintf(heading, tt.headingEtag, "new agenda")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			op := diffHeading(f.headings[0], base)
+			op.calID = "me@x.com"
+			op.cache = &eventCache{Events: map[string]*calendar.Event{}}
+			if err := applyOp(srv, op); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("applyOp: %v, want %v", err, tt.wantErr)
+			}
+			want := "agenda"
+			if tt.wantErr == nil {
+				want = "new agenda"
+			}
+			if fake.event.Description != want {
+				t.Errorf("description %q, want %q", fake.event.Description, want)
+			}
+		})
+	}
+}
+
+func TestSettleHeadings(t *testing.T) {
+	const heading = `** Review
+:PROPERTIES:
+:ID:       e1@google.com
+:GCALLINK: l
+:RSVP:     declined
+:RSVP_COMMENT: away
+:MINE:     x
+:END:
+`
+	tests := []struct {
+		name        string
+		applied     bool
+		wantChanged bool
+		wantRSVP    bool
+	}{
+		{name: "sent", applied: true, wantChanged: true},
+		{name: "failed", applied: false, wantRSVP: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseOrg(strings.NewReader(heading))
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := f.headings[0]
+			base := &calendar.Event{Id: "e1", ICalUID: "e1@google.com", Summary: "Review",
+				Attendees: []*calendar.EventAttendee{{Email: "me@x.com", Self: true, ResponseStatus: "accepted"}}}
+			op := diffHeading(h, base)
+			op.applied = tt.applied
+			if changed := settleHeadings([]*pushOp{op}); changed != tt.wantChanged {
+				t.Errorf("changed %v, want %v", changed, tt.wantChanged)
+			}
+			_, rsvp := h.property("RSVP")
+			_, comment := h.property("RSVP_COMMENT")
+			if rsvp != tt.wantRSVP || comment != tt.wantRSVP {
+				t.Errorf(":RSVP: left %v, :RSVP_COMMENT: left %v, want %v", rsvp, comment, tt.wantRSVP)
+			}
+			if _, ok := h.property("MINE"); !ok {
+				t.Errorf(":MINE: was dropped")
+			}
+		})
+	}
+}
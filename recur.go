@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// recurrence is an RRULE that org can express as repeaters.
+type recurrence struct {
+	every int    // repeater interval
+	unit  string // "d", "w", "m" or "y"
+
+	// offsets are the days from the event's start each repeating
+	// timestamp begins on. It's just 0, except for weekly rules on
+	// several days of the week, which get one timestamp per day.
+	offsets []int
+
+	// exdates are occurrences removed from the series.
+	exdates []*calendar.EventDateTime
+}
+
+// cookie returns the org repeater, e.g. "+2w".
+func (r *recurrence) cookie() string {
+	return fmt.Sprintf("+%d%s", r.every, r.unit)
+}
+
+// parseRecurrence turns the recurrence lines of a recurring event into org
+// repeaters. ok is false when they can't be expressed that way (COUNT,
+// UNTIL, "third thursday" and the like), and the instances have to be listed
+// one by one instead.
+func parseRecurrence(e *calendar.Event) (rec *recurrence, ok bool) {
+	start := eventStart(e)
+	if start.IsZero() || len(e.Recurrence) == 0 {
+		return nil, false
+	}
+	if e.Start.DateTime != "" {
+		start = start.In(time.Local)
+	}
+
+	var exdates []*calendar.EventDateTime
+	for _, line := range e.Recurrence {
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, false
+		}
+		params := strings.Split(line[:i], ";")
+		value := line[i+1:]
+		switch strings.ToUpper(params[0]) {
+		case "RRULE":
+			if rec != nil {
+				return nil, false
+			}
+			if rec, ok = parseRRule(value, start); !ok {
+				return nil, false
+			}
+		case "EXDATE":
+			dates, ok := parseExdates(params[1:], value, e.Start.TimeZone)
+			if !ok {
+				return nil, false
+			}
+			exdates = append(exdates, dates...)
+		default:
+			// RDATE and EXRULE have no org equivalent.
+			return nil, false
+		}
+	}
+	if rec == nil {
+		return nil, false
+	}
+	rec.exdates = exdates
+	return rec, true
+}
+
+var rruleDays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+func parseRRule(rule string, start time.Time) (*recurrence, bool) {
+	rec := &recurrence{every: 1, offsets: []int{0}}
+	var freq string
+	var byday []time.Weekday
+	wkst := time.Monday
+	for _, part := range strings.Split(rule, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, false
+		}
+		key, value := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+		switch key {
+		case "FREQ":
+			freq = value
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, false
+			}
+			rec.every = n
+		case "WKST":
+			d, ok := rruleDays[value]
+			if !ok {
+				return nil, false
+			}
+			wkst = d
+		case "BYDAY":
+			for _, v := range strings.Split(value, ",") {
+				// Numbered days ("3TH") aren't weekly.
+				d, ok := rruleDays[v]
+				if !ok {
+					return nil, false
+				}
+				byday = append(byday, d)
+			}
+		case "BYMONTHDAY":
+			if n, err := strconv.Atoi(value); err != nil || n != start.Day() {
+				return nil, false
+			}
+		case "BYMONTH":
+			if n, err := strconv.Atoi(value); err != nil || time.Month(n) != start.Month() {
+				return nil, false
+			}
+		default:
+			// COUNT, UNTIL, BYSETPOS...: org repeaters never end and
+			// can't pick days.
+			return nil, false
+		}
+	}
+
+	switch freq {
+	case "DAILY":
+		rec.unit = "d"
+	case "WEEKLY":
+		rec.unit = "w"
+	case "MONTHLY":
+		rec.unit = "m"
+	case "YEARLY":
+		rec.unit = "y"
+	default:
+		return nil, false
+	}
+	if len(byday) == 0 {
+		return rec, true
+	}
+	if rec.unit != "w" {
+		return nil, false
+	}
+
+	// A weekly rule on several days becomes a repeating timestamp per
+	// day, each starting on that day's first occurrence.
+	startDay := startOfDay(start)
+	weekStart := startDay.AddDate(0, 0, -((int(start.Weekday()) - int(wkst) + 7) % 7))
+	hasStart := false
+	rec.offsets = rec.offsets[:0]
+	for _, d := range byday {
+		day := weekStart.AddDate(0, 0, (int(d)-int(wkst)+7)%7)
+		if day.Before(startDay) {
+			day = day.AddDate(0, 0, 7*rec.every)
+		}
+		offset := int(day.Sub(startDay).Hours()/24 + 0.5)
+		if offset == 0 {
+			hasStart = true
+		}
+		rec.offsets = append(rec.offsets, offset)
+	}
+	if !hasStart {
+		// The start is an occurrence the rule doesn't produce.
+		return nil, false
+	}
+	sort.Ints(rec.offsets)
+	return rec, true
+}
+
+// parseExdates parses the value of an EXDATE line.
+func parseExdates(params []string, value, tzid string) ([]*calendar.EventDateTime, bool) {
+	isDate := false
+	for _, p := range params {
+		switch {
+		case strings.EqualFold(p, "VALUE=DATE"):
+			isDate = true
+		case strings.HasPrefix(strings.ToUpper(p), "TZID="):
+			tzid = p[len("TZID="):]
+		}
+	}
+	loc := time.Local
+	if tzid != "" {
+		l, err := time.LoadLocation(tzid)
+		if err != nil {
+			return nil, false
+		}
+		loc = l
+	}
+
+	var dates []*calendar.EventDateTime
+	for _, v := range strings.Split(value, ",") {
+		switch {
+		case isDate || len(v) == len("20060102"):
+			t, err := time.Parse("20060102", v)
+			if err != nil {
+				return nil, false
+			}
+			dates = append(dates, &calendar.EventDateTime{Date: t.Format("2006-01-02")})
+		case strings.HasSuffix(v, "Z"):
+			t, err := time.Parse("20060102T150405Z", v)
+			if err != nil {
+				return nil, false
+			}
+			dates = append(dates, &calendar.EventDateTime{DateTime: t.Format(time.RFC3339)})
+		default:
+			t, err := time.ParseInLocation("20060102T150405", v, loc)
+			if err != nil {
+				return nil, false
+			}
+			dates = append(dates, &calendar.EventDateTime{DateTime: t.Format(time.RFC3339)})
+		}
+	}
+	return dates, true
+}
+
+// shiftDate returns dt moved by days, keeping the time of day.
+func shiftDate(dt *calendar.EventDateTime, days int) *calendar.EventDateTime {
+	if dt == nil || days == 0 {
+		return dt
+	}
+	if dt.Date != "" {
+		t, _ := time.Parse("2006-01-02", dt.Date)
+		return &calendar.EventDateTime{Date: t.AddDate(0, 0, days).Format("2006-01-02")}
+	}
+	t, _ := time.Parse(time.RFC3339, dt.DateTime)
+	return &calendar.EventDateTime{
+		DateTime: t.In(time.Local).AddDate(0, 0, days).Format(time.RFC3339),
+		TimeZone: dt.TimeZone,
+	}
+}
+
+// withRepeater adds the repeater cookie to every timestamp in an org date.
+func withRepeater(date, cookie string) string {
+	date = strings.Replace(date, ">", " "+cookie+">", -1)
+	return strings.Replace(date, "]", " "+cookie+"]", -1)
+}
+
+// step returns t moved forward by n repeats.
+func (r *recurrence) step(t time.Time, n int) time.Time {
+	switch r.unit {
+	case "d":
+		return t.AddDate(0, 0, n*r.every)
+	case "w":
+		return t.AddDate(0, 0, 7*n*r.every)
+	case "m":
+		return t.AddDate(0, n*r.every, 0)
+	}
+	return t.AddDate(n*r.every, 0, 0)
+}
+
+// nextOccurrence returns the start of the first occurrence of the recurring
+// event e that hasn't ended by now. Removed occurrences still count.
+func (r *recurrence) nextOccurrence(e *calendar.Event, now time.Time) time.Time {
+	start := eventStart(e)
+	length := eventEnd(e).Sub(start)
+	var next time.Time
+	for _, offset := range r.offsets {
+		first := start.AddDate(0, 0, offset)
+		t := first
+		for n := 1; !t.Add(length).After(now); n++ {
+			t = r.step(first, n)
+		}
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	return next
+}
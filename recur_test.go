@@ -0,0 +1,166 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// inUTC runs the test with time.Local set to UTC, so dates don't depend on
+// the machine's time zone.
+func inUTC(t *testing.T) {
+	local := time.Local
+	time.Local = time.UTC
+	t.Cleanup(func() { time.Local = local })
+}
+
+func TestParseRecurrence(t *testing.T) {
+	inUTC(t)
+	// 2026-10-13 is a Tuesday.
+	timed := &calendar.EventDateTime{DateTime: "2026-10-13T10:00:00Z"}
+	allDay := &calendar.EventDateTime{Date: "2026-10-13"}
+	tests := []struct {
+		name        string
+		start       *calendar.EventDateTime
+		recurrence  []string
+		wantOK      bool
+		wantCookie  string
+		wantOffsets []int
+		wantExdates []calendar.EventDateTime
+	}{
+		{
+			name:       "daily",
+			start:      timed,
+			recurrence: []string{"RRULE:FREQ=DAILY"},
+			wantOK:     true, wantCookie: "+1d", wantOffsets: []int{0},
+		},
+		{
+			name:       "every other week",
+			start:      timed,
+			recurrence: []string{"RRULE:FREQ=WEEKLY;INTERVAL=2"},
+			wantOK:     true, wantCookie: "+2w", wantOffsets: []int{0},
+		},
+		{
+			name:       "weekly on the start day",
+			start:      timed,
+			recurrence: []string{"RRULE:FREQ=WEEKLY;BYDAY=TU"},
+			wantOK:     true, wantCookie: "+1w", wantOffsets: []int{0},
+		},
+		{
+			name:       "weekly on several days",
+			start:      timed,
+			recurrence: []string{"RRULE:FREQ=WEEKLY;BYDAY=TU,TH,MO"},
+			wantOK:     true, wantCookie: "+1w", wantOffsets: []int{0, 2, 6},
+		},
+		{
+			name:       "weekly not on the start day",
+			start:      timed,
+			recurrence: []string{"RRULE:FREQ=WEEKLY;BYDAY=WE"},
+		},
+		{
+			name:       "monthly on the start day",
+			start:      allDay,
+			recurrence: []string{"RRULE:FREQ=MONTHLY;BYMONTHDAY=13"},
+			wantOK:     true, wantCookie: "+1m", wantOffsets: []int{0},
+		},
+		{
+			name:       "monthly on another day",
+			start:      allDay,
+			recurrence: []string{"RRULE:FREQ=MONTHLY;BYMONTHDAY=14"},
+		},
+		{
+			name:       "third thursday",
+			start:      timed,
+			recurrence: []string{"RRULE:FREQ=MONTHLY;BYDAY=3TH"},
+		},
+		{
+			name:       "yearly",
+			start:      allDay,
+			recurrence: []string{"RRULE:FREQ=YEARLY;BYMONTH=10"},
+			wantOK:     true, wantCookie: "+1y", wantOffsets: []int{0},
+		},
+		{
+			name:       "count",
+			start:      timed,
+			recurrence: []string{"RRULE:FREQ=DAILY;COUNT=5"},
+		},
+		{
+			name:       "until",
+			start:      timed,
+			recurrence: []string{"RRULE:FREQ=WEEKLY;UNTIL=20261231T000000Z"},
+		},
+		{
+			name:       "bad interval",
+			start:      timed,
+			recurrence: []string{"RRULE:FREQ=DAILY;INTERVAL=0"},
+		},
+		{
+			name:       "rdate",
+			start:      timed,
+			recurrence: []string{"RRULE:FREQ=DAILY", "RDATE:20261020T100000Z"},
+		},
+		{
+			name:       "two rules",
+			start:      timed,
+			recurrence: []string{"RRULE:FREQ=DAILY", "RRULE:FREQ=WEEKLY"},
+		},
+		{
+			name:       "no rule",
+			start:      timed,
+			recurrence: []string{"EXDATE:20261014T100000Z"},
+		},
+		{
+			name:  "exdates",
+			start: timed,
+			recurrence: []string{
+				"RRULE:FREQ=DAILY",
+				"EXDATE;TZID=Europe/Berlin:20261014T120000,20261015T120000",
+				"EXDATE;VALUE=DATE:20261016",
+				"EXDATE:20261017T100000Z",
+			},
+			wantOK: true, wantCookie: "+1d", wantOffsets: []int{0},
+			wantExdates: []calendar.EventDateTime{
+				{DateTime: "2026-10-14T12:00:00+02:00"},
+				{DateTime: "2026-10-15T12:00:00+02:00"},
+				{Date: "2026-10-16"},
+				{DateTime: "2026-10-17T10:00:00Z"},
+			},
+		},
+		{
+			name:       "unknown time zone",
+			start:      timed,
+			recurrence: []string{"RRULE:FREQ=DAILY", "EXDATE;TZID=Nowhere/Else:20261014T120000"},
+		},
+		{
+			name:  "not recurring",
+			start: timed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &calendar.Event{Start: tt.start, Recurrence: tt.recurrence}
+			rec, ok := parseRecurrence(e)
+			if ok != tt.wantOK {
+				t.Fatalf("parseRecurrence(%q) ok = %v, want %v", tt.recurrence, ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got := rec.cookie(); got != tt.wantCookie {
+				t.Errorf("cookie %q, want %q", got, tt.wantCookie)
+			}
+			if !reflect.DeepEqual(rec.offsets, tt.wantOffsets) {
+				t.Errorf("offsets %v, want %v", rec.offsets, tt.wantOffsets)
+			}
+			var exdates []calendar.EventDateTime
+			for _, d := range rec.exdates {
+				exdates = append(exdates, *d)
+			}
+			if !reflect.DeepEqual(exdates, tt.wantExdates) {
+				t.Errorf("exdates %+v, want %+v", exdates, tt.wantExdates)
+			}
+		})
+	}
+}
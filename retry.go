@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// retryConfig is the [retry] section of the config, saying how API calls
+// that hit rate limits or server errors are retried.
+type retryConfig struct {
+	// MaxRetries is how often a call is retried, 0 turns retrying off.
+	MaxRetries *int `toml:"max_retries"`
+
+	// InitialBackoff doubles after every retry up to MaxBackoff, and
+	// Deadline bounds the time from the start of the command after which
+	// nothing is retried anymore.
+	InitialBackoff string `toml:"initial_backoff"`
+	MaxBackoff     string `toml:"max_backoff"`
+	Deadline       string `toml:"deadline"`
+}
+
+// retryPolicy is how retryTransport retries.
+type retryPolicy struct {
+	maxRetries int
+	initial    time.Duration
+	max        time.Duration
+	deadline   time.Duration
+
+	// stop is when retrying ends: deadline after the command started.
+	stop time.Time
+}
+
+var defaultRetryPolicy = retryPolicy{
+	maxRetries: 5,
+	initial:    time.Second,
+	max:        32 * time.Second,
+	deadline:   2 * time.Minute,
+}
+
+// policy returns the retry policy c describes for a command started at
+// start, with defaults for what it leaves out.
+func (c *retryConfig) policy(start time.Time) (retryPolicy, error) {
+	p := defaultRetryPolicy
+	if c.MaxRetries != nil {
+		if *c.MaxRetries < 0 {
+			return p, fmt.Errorf("retry: max_retries can't be negative")
+		}
+		p.maxRetries = *c.MaxRetries
+	}
+	for _, d := range []struct {
+		name string
+		s    string
+		dst  *time.Duration
+	}{
+		{"initial_backoff", c.InitialBackoff, &p.initial},
+		{"max_backoff", c.MaxBackoff, &p.max},
+		{"deadline", c.Deadline, &p.deadline},
+	} {
+		if d.s == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.s)
+		if err != nil || v <= 0 {
+			return p, fmt.Errorf("retry: bad %s %q, want a duration like 30s", d.name, d.s)
+		}
+		*d.dst = v
+	}
+	if p.max < p.initial {
+		return p, fmt.Errorf("retry: max_backoff is shorter than initial_backoff")
+	}
+	p.stop = start.Add(p.deadline)
+	return p, nil
+}
+
+// backoff returns how long to wait before retry number n (from 0): the
+// initial backoff doubled n times, capped, with the upper half jittered so
+// accounts that failed together don't retry together.
+func (p retryPolicy) backoff(n int) time.Duration {
+	d := p.initial
+	for i := 0; i < n && d < p.max; i++ {
+		d *= 2
+	}
+	if d > p.max {
+		d = p.max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryTransport retries requests the calendar API answers with a rate
+// limit or a server error, until the policy's stop time. All the requests of
+// a command share that, so a struggling API can't hold a cron run up for
+// the deadline once per call.
+type retryTransport struct {
+	base   http.RoundTripper
+	policy retryPolicy
+
+	// now and sleep tell the time and wait d or until the request is
+	// cancelled; tests can replace them.
+	now   func() time.Time
+	sleep func(req *http.Request, d time.Duration) error
+}
+
+func newRetryTransport(base http.RoundTripper, policy retryPolicy) *retryTransport {
+	return &retryTransport{base: base, policy: policy, now: time.Now, sleep: sleepRequest}
+}
+
+func sleepRequest(req *http.Request, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for n := 0; ; n++ {
+		if n > 0 && req.Body != nil {
+			if req.GetBody == nil {
+				return nil, fmt.Errorf("can't retry %s %s, its body can't be replayed", req.Method, req.URL)
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r := *req
+			r.Body = body
+			req = &r
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || n >= t.policy.maxRetries {
+			return resp, err
+		}
+		reason, retry := retryable(resp)
+		if !retry {
+			return resp, nil
+		}
+
+		wait := t.policy.backoff(n)
+		if after, ok := retryAfter(resp); ok && after > wait {
+			wait = after
+		}
+		if t.now().Add(wait).After(t.policy.stop) {
+			return resp, nil
+		}
+		resp.Body.Close()
+		fmt.Fprintf(os.Stderr, "%s %s: %s, retrying in %v\n", req.Method, req.URL.Path, reason,
+			wait.Round(100*time.Millisecond))
+		if err := t.sleep(req, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryable reports whether resp is worth retrying, and why. 403s are only
+// retried for rate limits, which means peeking at the error body; resp's body
+// is left readable.
+func retryable(resp *http.Response) (reason string, ok bool) {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return resp.Status, true
+	case http.StatusForbidden:
+	default:
+		return "", false
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return "", false
+	}
+	var body struct {
+		Error struct {
+			Errors []struct {
+				Reason string `json:"reason"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(b, &body) != nil {
+		return "", false
+	}
+	for _, e := range body.Error.Errors {
+		switch e.Reason {
+		case "rateLimitExceeded", "userRateLimitExceeded":
+			return e.Reason, true
+		}
+	}
+	return "", false
+}
+
+// retryAfter returns the wait the server asked for in a Retry-After header,
+// given in seconds or as a date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	h := resp.Header.Get("Retry-After")
+	if h == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(h); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
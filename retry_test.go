@@ -0,0 +1,210 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedServer answers requests with the responses in order, repeating
+// the last one, and records the request bodies it got.
+type scriptedServer struct {
+	mu        sync.Mutex
+	responses []scriptedResponse
+	bodies    []string
+}
+
+type scriptedResponse struct {
+	code       int
+	retryAfter string
+	body       string
+}
+
+func (s *scriptedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, _ := ioutil.ReadAll(r.Body)
+	s.bodies = append(s.bodies, string(b))
+	resp := s.responses[len(s.responses)-1]
+	if len(s.bodies) <= len(s.responses) {
+		resp = s.responses[len(s.bodies)-1]
+	}
+	if resp.retryAfter != "" {
+		w.Header().Set("Retry-After", resp.retryAfter)
+	}
+	w.WriteHeader(resp.code)
+	w.Write([]byte(resp.body))
+}
+
+const rateLimitBody = `{"error":{"errors":[{"reason":"rateLimitExceeded"}],"code":403}}`
+
+func TestRetryTransport(t *testing.T) {
+	start := time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC)
+	policy := retryPolicy{maxRetries: 3, initial: time.Second, max: 4 * time.Second, stop: start.Add(time.Minute)}
+	tests := []struct {
+		name      string
+		policy    retryPolicy
+		responses []scriptedResponse
+		wantCode  int
+		wantCalls int
+		// wantMinWaits are lower bounds of the waits between calls.
+		wantMinWaits []time.Duration
+	}{
+		{
+			name:      "ok",
+			policy:    policy,
+			responses: []scriptedResponse{{code: 200}},
+			wantCode:  200, wantCalls: 1,
+		},
+		{
+			name:      "server errors",
+			policy:    policy,
+			responses: []scriptedResponse{{code: 503}, {code: 500}, {code: 200}},
+			wantCode:  200, wantCalls: 3,
+			wantMinWaits: []time.Duration{time.Second / 2, time.Second},
+		},
+		{
+			name:      "rate limit",
+			policy:    policy,
+			responses: []scriptedResponse{{code: 429}, {code: 403, body: rateLimitBody}, {code: 200}},
+			wantCode:  200, wantCalls: 3,
+			wantMinWaits: []time.Duration{time.Second / 2, time.Second},
+		},
+		{
+			name:      "forbidden",
+			policy:    policy,
+			responses: []scriptedResponse{{code: 403, body: `{"error":{"errors":[{"reason":"forbidden"}]}}`}},
+			wantCode:  403, wantCalls: 1,
+		},
+		{
+			name:      "not found",
+			policy:    policy,
+			responses: []scriptedResponse{{code: 404}},
+			wantCode:  404, wantCalls: 1,
+		},
+		{
+			name:      "retry after",
+			policy:    policy,
+			responses: []scriptedResponse{{code: 503, retryAfter: "30"}, {code: 200}},
+			wantCode:  200, wantCalls: 2,
+			wantMinWaits: []time.Duration{30 * time.Second},
+		},
+		{
+			name:      "max retries",
+			policy:    policy,
+			responses: []scriptedResponse{{code: 503}},
+			wantCode:  503, wantCalls: 4,
+		},
+		{
+			name:      "deadline",
+			policy:    retryPolicy{maxRetries: 5, initial: time.Second, max: time.Second, stop: start.Add(10 * time.Second)},
+			responses: []scriptedResponse{{code: 503, retryAfter: "60"}, {code: 200}},
+			wantCode:  503, wantCalls: 1,
+		},
+		{
+			name:      "disabled",
+			policy:    retryPolicy{maxRetries: 0, initial: time.Second, max: time.Second, stop: start.Add(time.Minute)},
+			responses: []scriptedResponse{{code: 503}, {code: 200}},
+			wantCode:  503, wantCalls: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &scriptedServer{responses: tt.responses}
+			ts := httptest.NewServer(srv)
+			defer ts.Close()
+
+			var waits []time.Duration
+			rt := newRetryTransport(http.DefaultTransport, tt.policy)
+			rt.now = func() time.Time { return start }
+			rt.sleep = func(req *http.Request, d time.Duration) error {
+				waits = append(waits, d)
+				return nil
+			}
+			req, err := http.NewRequest("POST", ts.URL, strings.NewReader("payload"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if got := len(srv.bodies); got != tt.wantCalls {
+				t.Errorf("%d calls, want %d", got, tt.wantCalls)
+			}
+			for i, b := range srv.bodies {
+				if b != "payload" {
+					t.Errorf("call %d got body %q, want it replayed", i, b)
+				}
+			}
+			if len(waits) != tt.wantCalls-1 {
+				t.Errorf("waited %d times, want %d", len(waits), tt.wantCalls-1)
+			}
+			for i, min := range tt.wantMinWaits {
+				if i < len(waits) && waits[i] < min {
+					t.Errorf("wait %d is %v, want at least %v", i, waits[i], min)
+				}
+			}
+			if tt.wantCode == 403 && !strings.Contains(string(body), "reason") {
+				t.Errorf("403 body %q wasn't left readable", body)
+			}
+		})
+	}
+}
+
+func TestRetryDeadlineShared(t *testing.T) {
+	srv := &scriptedServer{responses: []scriptedResponse{{code: 503, retryAfter: "6"}}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	clock := time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC)
+	rt := newRetryTransport(http.DefaultTransport, retryPolicy{
+		maxRetries: 5, initial: time.Second, max: time.Second, stop: clock.Add(10 * time.Second),
+	})
+	rt.now = func() time.Time { return clock }
+	rt.sleep = func(req *http.Request, d time.Duration) error {
+		clock = clock.Add(d)
+		return nil
+	}
+	// The first call retries once and gives up, the wait after that would
+	// end past the deadline. The second starts with too little time left
+	// to retry at all.
+	for i, wantCalls := range []int{2, 3} {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 503 {
+			t.Errorf("call %d: status %d, want 503", i, resp.StatusCode)
+		}
+		if got := len(srv.bodies); got != wantCalls {
+			t.Errorf("after call %d: %d requests, want %d", i, got, wantCalls)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := retryPolicy{initial: time.Second, max: 8 * time.Second}
+	for n, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second} {
+		for i := 0; i < 20; i++ {
+			if d := p.backoff(n); d < want/2 || d > want {
+				t.Errorf("backoff(%d) = %v, want between %v and %v", n, d, want/2, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+var respondCmd = &command{
+	name:  "respond",
+	args:  "[flags] <event> accepted|declined|tentative",
+	short: "answer an invitation",
+	long: `
+Respond sets your response to an event, given by its event id or the :ID:
+of its heading, like setting :RSVP: on the heading and pushing does.
+The event is looked up in the exported calendars; use --calendar for others.
+
+Responding needs permission to change events. gcalorg asks for it the first
+time it's needed, or authorize it ahead of time with 'gcalorg auth --write'.
+`,
+	run: runRespond,
+}
+
+var rsvpStatuses = map[string]bool{"accepted": true, "declined": true, "tentative": true}
+
+// selfAttendee returns the attendee of e that is the account's user.
+func selfAttendee(e *calendar.Event) *calendar.EventAttendee {
+	for _, a := range e.Attendees {
+		if a != nil && a.Self {
+			return a
+		}
+	}
+	return nil
+}
+
+// rsvpPatch returns the attendee list of e with our response set to status,
+// and a description of the change. The list is nil if we already answered
+// that way.
+func rsvpPatch(e *calendar.Event, status, comment string) ([]*calendar.EventAttendee, string, error) {
+	if !rsvpStatuses[status] {
+		return nil, "", fmt.Errorf("bad response %q, want accepted, declined or tentative", status)
+	}
+	self := selfAttendee(e)
+	if self == nil {
+		return nil, "", fmt.Errorf("you aren't an attendee of %q", e.Summary)
+	}
+	if self.ResponseStatus == status && (comment == "" || comment == self.Comment) {
+		return nil, "", nil
+	}
+
+	// The whole list has to be sent, with just our entry changed.
+	attendees := make([]*calendar.EventAttendee, 0, len(e.Attendees))
+	for _, a := range e.Attendees {
+		if a == self {
+			answered := *a
+			answered.ResponseStatus = status
+			if comment != "" {
+				answered.Comment = comment
+			}
+			a = &answered
+		}
+		attendees = append(attendees, a)
+	}
+	change := fmt.Sprintf("rsvp: %s -> %s", self.ResponseStatus, status)
+	if comment != "" && comment != self.Comment {
+		change += fmt.Sprintf(" (%q)", comment)
+	}
+	return attendees, change, nil
+}
+
+func runRespond(cmd *command, args []string) error {
+	fs := cmd.flags()
+	configPath := configFlag(fs)
+	accountName := fs.String("account", "", "account the event is in (default: search all)")
+	calID := fs.String("calendar", "", "calendar the event is in (default: search the exported ones)")
+	comment := fs.String("comment", "", "comment to send with the response")
+	if err := cmd.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return usageError(fmt.Errorf("expected an event and a response"))
+	}
+	eventID, status := fs.Arg(0), fs.Arg(1)
+	if !rsvpStatuses[status] {
+		return usageError(fmt.Errorf("bad response %q, want accepted, declined or tentative", status))
+	}
+
+	conf, err := loadConfig(*configPath)
+	if err != nil {
+		return configError(err)
+	}
+	accts, err := conf.selectAccounts(*accountName)
+	if err != nil {
+		return configError(err)
+	}
+	if *calID != "" && len(accts) != 1 {
+		return usageError(fmt.Errorf("--calendar needs --account"))
+	}
+
+	op, err := findRespondTarget(accts, *calID, eventID)
+	if err != nil {
+		return err
+	}
+	if op.base == nil {
+		// Not exported, ask google for it.
+		client, err := genClient(op.acct, calendar.CalendarReadonlyScope)
+		if err != nil {
+			return err
+		}
+		srv, err := calendar.New(client)
+		if err != nil {
+			return apiError(fmt.Errorf("unable to create calendar client: %w", err))
+		}
+		if op.base, err = srv.Events.Get(op.calID, eventID).Do(); err != nil {
+			return apiError(fmt.Errorf("unable to get event %s: %w", eventID, err))
+		}
+		op.etag = op.base.Etag
+	}
+
+	attendees, change, err := rsvpPatch(op.base, status, *comment)
+	if err != nil {
+		return usageError(err)
+	}
+	if attendees == nil {
+		fmt.Fprintf(os.Stderr, "already %s\n", status)
+		return nil
+	}
+	op.patch = &calendar.Event{Attendees: attendees}
+	op.changes = []string{change}
+	op.print(os.Stdout)
+	return applyPush([]*pushOp{op})
+}
+
+// findRespondTarget looks the event up in the event caches of the accounts,
+// or the cache of calID if given.
+func findRespondTarget(accts []*account, calID, eventID string) (*pushOp, error) {
+	for _, acct := range accts {
+		cals := []string{calID}
+		if calID == "" {
+			cals = cals[:0]
+			for _, cal := range acct.Calendars {
+				cals = append(cals, cal.ID)
+			}
+		}
+		for _, id := range cals {
+			path, err := eventCachePath(acct, id)
+			if err != nil {
+				return nil, err
+			}
+			cache := loadEventCache(path, id)
+			base, ok := cache.Events[eventID]
+			if !ok {
+				base = cache.findEvent(eventID)
+			}
+			if base == nil && calID == "" {
+				continue
+			}
+			op := &pushOp{acct: acct, calID: id, base: base, cache: cache, path: path}
+			if base != nil {
+				op.etag = base.Etag
+			}
+			return op, nil
+		}
+	}
+	return nil, usageError(fmt.Errorf("no event %s in the exported calendars, try --account and --calendar", eventID))
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// templateConfig is the [templates] section of the config: text/template
+// files replacing the built-in ones that write the file header, calendar
+// headings and event headings.
+type templateConfig struct {
+	Header   string `toml:"header"`
+	Calendar string `toml:"calendar"`
+	Event    string `toml:"event"`
+}
+
+// headerView is what the header template sees.
+type headerView struct {
+	// Notes are the comments about accounts rendered from a snapshot.
+	Notes []string
+}
+
+// calendarView is what the calendar template sees.
+type calendarView struct {
+	Account string
+	ID      string
+	Title   string // the calendar's summary, todo keywords defused
+	Tag     string
+	Entry   *calendar.CalendarListEntry
+}
+
+// eventView is what the event template sees, for the heading of an event
+// and its moved and cancelled occurrences.
+type eventView struct {
+	// Level is the heading level.
+	Level int
+
+	// Event is the event the heading stands for, see groupHead, and
+	// Events all of them.
+	Event  *calendar.Event
+	Events []*calendar.Event
+
+	Title  string // the summary, todo keywords defused, "busy" without one
+	Status string // "cancelled" or "tentative" if the heading says so
+
+	// Tag and CalendarID are only set when the heading isn't under its
+	// calendar's heading. Tags are all the heading's tags: Tag, and "free"
+	// for events that don't block time.
+	Tag        string
+	CalendarID string
+	Tags       []string
+
+	Occurrences []occurrenceView
+
+	// Bodies are the different descriptions of the events, see the
+	// description function.
+	Bodies []string
+}
+
+// occurrenceView is one event of an eventView.
+type occurrenceView struct {
+	Event *calendar.Event
+
+	// Attending is false for events declined by one of the calendar's
+	// attendee_filters, which get inactive timestamps.
+	Attending bool
+
+	// Timestamps are the org timestamp lines of the event.
+	Timestamps string
+
+	// Attendees is the attendee list, empty if an earlier occurrence
+	// already had the same one.
+	Attendees string
+}
+
+// templateFuncs are the helpers templates can use besides the built-in ones.
+var templateFuncs = template.FuncMap{
+	// stars returns the stars of a heading at level n.
+	"stars": func(n int) string { return strings.Repeat("*", n) },
+
+	// escape makes text safe to put into org: links and headings in it
+	// don't work anymore. noTodo keeps a todo keyword at the start of a
+	// title from being read as the heading's todo state.
+	"escape": cleanString,
+	"noTodo": noTodoKwds,
+
+	// timestamp and inactive format an event's start and end as an org
+	// timestamp or range.
+	"timestamp": datesToOrg,
+	"inactive":  datesToInactiveOrg,
+
+	// dates returns the timestamp lines of an event, with repeaters for
+	// recurring events.
+	"dates": fmtOrgDate,
+
+	// mailto and link return org links, with the description escaped.
+	"mailto": func(email, name string) string {
+		return fmt.Sprintf("[[mailto:%s][%s]]", email, cleanString(name))
+	},
+	"link": func(url, desc string) string {
+		if desc == "" {
+			return fmt.Sprintf("[[%s]]", url)
+		}
+		return fmt.Sprintf("[[%s][%s]]", url, cleanString(desc))
+	},
+
+	// instant formats an API time like .Event.Updated as an inactive
+	// org timestamp.
+	"instant": func(s string) string {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return s
+		}
+		return t.In(time.Local).Format("[2006-01-02 Mon 15:04]")
+	},
+
+	// oneLine puts text on one line, for property values.
+	"oneLine": func(s string) string { return strings.Join(strings.Fields(s), " ") },
+
+	// colorName returns the name google calendar shows for an event
+	// color id.
+	"colorName": func(id string) string {
+		if name, ok := eventColors[id]; ok {
+			return name
+		}
+		return id
+	},
+
+	// attendees and description return the attendee list and the
+	// "Summary:" block of an event as the built-in template writes them.
+	"attendees":   fmtOrgAttendees,
+	"description": fmtOrgBody,
+
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+}
+
+// eventColors are the names of the event colors by their id.
+var eventColors = map[string]string{
+	"1": "Lavender", "2": "Sage", "3": "Grape", "4": "Flamingo",
+	"5": "Banana", "6": "Tangerine", "7": "Peacock", "8": "Graphite",
+	"9": "Blueberry", "10": "Basil", "11": "Tomato",
+}
+
+// freeTag is the tag of events that don't block time, so agendas can leave
+// them out.
+const freeTag = "free"
+
+const defaultHeaderTemplate = `# -*- eval: (auto-revert-mode 1); -*-
+#+category: cal
+{{range .Notes}}# {{.}}
+{{end}}`
+
+const defaultCalendarTemplate = `* {{.Title}}{{with .Tag}} :{{.}}:{{end}}
+  :PROPERTIES:
+  :ID:         {{.ID}}
+  :END:
+
+{{.Entry.Description}}
+
+`
+
+const defaultEventTemplate = `{{stars .Level}} {{with .Status}}({{.}}) {{end}}{{.Title}}{{with .Tags}} :{{join . ":"}}:{{end}}
+:PROPERTIES:
+:ID:       {{.Event.ICalUID}}
+{{with .CalendarID}}:CALENDAR: {{.}}
+{{end}}:GCALLINK: {{.Event.HtmlLink}}
+{{with .Event.Etag}}:ETAG: {{.}}
+{{end}}{{with .Event.Creator}}:CREATOR: {{mailto .Email .DisplayName}}
+{{end}}{{with .Event.Organizer}}:ORGANIZER: {{mailto .Email .DisplayName}}
+{{end}}{{with .Event.Location}}:LOCATION: {{oneLine .}}
+{{end}}{{with .Event.HangoutLink}}:MEETING: {{link . "Google Meet"}}
+{{end}}{{with .Event.Status}}:STATUS: {{.}}
+{{end}}{{with .Event.Transparency}}:TRANSPARENCY: {{.}}
+{{end}}{{with .Event.Visibility}}:VISIBILITY: {{.}}
+{{end}}{{with .Event.ColorId}}:COLOR: {{colorName .}}
+{{end}}{{with .Event.Created}}:CREATED: {{instant .}}
+{{end}}{{with .Event.Updated}}:UPDATED: {{instant .}}
+{{end}}:SEQUENCE: {{.Event.Sequence}}
+:END:
+
+{{range .Occurrences}}{{.Timestamps}}{{.Attendees}}{{end}}{{range .Bodies}}{{.}}{{end}}
+`
+
+// orgTemplates are the templates export writes the file with.
+type orgTemplates struct {
+	header   *template.Template
+	calendar *template.Template
+	event    *template.Template
+}
+
+// templates parses the templates c names, relative to base, falling back to
+// the built-in ones.
+func (c *templateConfig) templates(base string) (*orgTemplates, error) {
+	t := &orgTemplates{}
+	for _, tt := range []struct {
+		name string
+		path string
+		def  string
+		dst  **template.Template
+	}{
+		{"header", c.Header, defaultHeaderTemplate, &t.header},
+		{"calendar", c.Calendar, defaultCalendarTemplate, &t.calendar},
+		{"event", c.Event, defaultEventTemplate, &t.event},
+	} {
+		text := tt.def
+		if tt.path != "" {
+			path := expandPath(tt.path, base)
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("templates: %v", err)
+			}
+			text = string(b)
+		}
+		tmpl, err := template.New(tt.name).Funcs(templateFuncs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("templates: %v", err)
+		}
+		*tt.dst = tmpl
+	}
+	return t, nil
+}
+
+// newEventView returns the view of event group g for a heading at level.
+// standalone headings aren't under their calendar's heading.
+func newEventView(g *eventGroup, level int, standalone bool) *eventView {
+	// take the last header of the set, has the most recent summary info.
+	e := g.head
+	v := &eventView{Level: level, Event: e, Events: g.events, Title: e.Summary}
+	if v.Title == "" {
+		v.Title = "busy"
+	}
+	v.Title = noTodoKwds(v.Title)
+	if e.Status == "tentative" || e.Status == "cancelled" {
+		v.Status = e.Status
+	}
+	if standalone {
+		v.Tag, v.CalendarID = g.cal.tag(g.acct), g.cal.ID
+		if v.Tag != "" {
+			v.Tags = append(v.Tags, v.Tag)
+		}
+	}
+	if e.Transparency == "transparent" {
+		v.Tags = append(v.Tags, freeTag)
+	}
+
+	// Put the dates from each event repeat
+	unique_attendees := make(map[string]struct{})
+	for _, i := range g.events {
+		o := occurrenceView{Event: i, Attending: attendingEvent(g.cal, *i)}
+		if o.Attending {
+			o.Timestamps = fmtOrgDate(i)
+		} else {
+			o.Timestamps = fmtInactiveOrgDate(i)
+		}
+		attendee := fmtOrgAttendees(i)
+		if _, ok := unique_attendees[attendee]; !ok {
+			unique_attendees[attendee] = struct{}{}
+			o.Attendees = attendee
+		}
+		v.Occurrences = append(v.Occurrences, o)
+	}
+
+	unique_bodies := make(map[string]struct{})
+	// Remove duplicate bodies
+	for _, i := range g.events {
+		if isCancelledOccurrence(i) {
+			continue
+		}
+		body := fmtOrgBody(i)
+		if _, ok := unique_bodies[body]; !ok {
+			unique_bodies[body] = struct{}{}
+			v.Bodies = append(v.Bodies, body)
+		}
+	}
+	return v
+}
+
+func (t *orgTemplates) writeHeader(w io.Writer, notes []string) error {
+	return t.header.Execute(w, &headerView{Notes: notes})
+}
+
+func (t *orgTemplates) writeCalendar(w io.Writer, acct *account, cd *calendarData) error {
+	return t.calendar.Execute(w, &calendarView{
+		Account: acct.Name,
+		ID:      cd.entry.Id,
+		Title:   noTodoKwds(cd.entry.Summary),
+		Tag:     cd.conf.tag(acct),
+		Entry:   cd.entry,
+	})
+}
+
+func (t *orgTemplates) writeEvent(w io.Writer, g *eventGroup, level int, standalone bool) error {
+	if err := t.event.Execute(w, newEventView(g, level, standalone)); err != nil {
+		return fmt.Errorf("event %s: %w", g.head.ICalUID, err)
+	}
+	return nil
+}
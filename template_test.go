@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// goldenResults is one account with a calendar of the kinds of events the
+// built-in templates have to get right.
+func goldenResults() []*accountData {
+	cal := &calendarConfig{ID: "me@x.com", AttendeeFilters: []string{"me@x.com"}}
+	acct := &account{Name: "work", Tag: "WORK", Calendars: []*calendarConfig{cal}}
+	people := func(self string) []*calendar.EventAttendee {
+		return []*calendar.EventAttendee{
+			{Email: "boss@x.com", DisplayName: "The [Boss]", Organizer: true, ResponseStatus: "accepted"},
+			{Email: "me@x.com", Self: true, ResponseStatus: self},
+		}
+	}
+	events := []*calendar.Event{
+		{
+			Id: "r1", ICalUID: "r1@google.com", Summary: "Review", HtmlLink: "https://x/r1",
+			Description: "see [[https://x.com][the doc]]\n* not a heading",
+			Creator:     &calendar.EventCreator{Email: "boss@x.com", DisplayName: "The [Boss]"},
+			Organizer:   &calendar.EventOrganizer{Email: "boss@x.com"},
+			Start:       &calendar.EventDateTime{DateTime: "2026-10-19T10:00:00Z"},
+			End:         &calendar.EventDateTime{DateTime: "2026-10-19T11:30:00Z"},
+			Attendees:   people("accepted"),
+			Attachments: []*calendar.EventAttachment{{FileUrl: "https://x/f", Title: "Slides [v2]"}},
+		},
+		{
+			Id: "t1", ICalUID: "t1@google.com", Summary: "Trip", HtmlLink: "https://x/t1",
+			Start: &calendar.EventDateTime{Date: "2026-10-22"},
+			End:   &calendar.EventDateTime{Date: "2026-10-25"},
+		},
+		{
+			Id: "b1", ICalUID: "b1@google.com", HtmlLink: "https://x/b1",
+			Start: &calendar.EventDateTime{DateTime: "2026-10-17T08:00:00Z"},
+			End:   &calendar.EventDateTime{DateTime: "2026-10-17T09:00:00Z"},
+		},
+		{
+			Id: "d1", ICalUID: "d1@google.com", Summary: "TODO planning", HtmlLink: "https://x/d1",
+			Start:     &calendar.EventDateTime{DateTime: "2026-10-20T14:00:00Z"},
+			End:       &calendar.EventDateTime{DateTime: "2026-10-20T15:00:00Z"},
+			Attendees: people("declined"),
+		},
+		{
+			Id: "w1", ICalUID: "w1@google.com", Summary: "Standup", HtmlLink: "https://x/w1",
+			Start:      &calendar.EventDateTime{DateTime: "2026-10-05T09:00:00Z"},
+			End:        &calendar.EventDateTime{DateTime: "2026-10-05T09:15:00Z"},
+			Recurrence: []string{"RRULE:FREQ=WEEKLY;BYDAY=MO,WE"},
+		},
+		{
+			Id: "w1_20261014T090000Z", ICalUID: "w1@google.com", Summary: "Standup (moved)",
+			RecurringEventId: "w1", HtmlLink: "https://x/w1m",
+			OriginalStartTime: &calendar.EventDateTime{DateTime: "2026-10-14T09:00:00Z"},
+			Start:             &calendar.EventDateTime{DateTime: "2026-10-15T09:00:00Z"},
+			End:               &calendar.EventDateTime{DateTime: "2026-10-15T09:15:00Z"},
+		},
+		{
+			Id: "w1_20261019T090000Z", RecurringEventId: "w1", Status: "cancelled",
+			OriginalStartTime: &calendar.EventDateTime{DateTime: "2026-10-19T09:00:00Z"},
+		},
+	}
+	return []*accountData{{
+		acct: acct,
+		calendars: []*calendarData{{
+			conf:   cal,
+			entry:  &calendar.CalendarListEntry{Id: cal.ID, Summary: "Me", Description: "my cal"},
+			events: events,
+		}},
+	}}
+}
+
+// The built-in templates write what export wrote before there were
+// templates, plus the properties added since.
+const goldenCalendar = `# -*- eval: (auto-revert-mode 1); -*-
+#+category: cal
+* Me :WORK:
+  :PROPERTIES:
+  :ID:         me@x.com
+  :END:
+
+my cal
+
+** Standup
+:PROPERTIES:
+:ID:       w1@google.com
+:GCALLINK: https://x/w1
+:SEQUENCE: 0
+:END:
+
+<2026-10-05 Mon 09:00-09:15 +1w>
+<2026-10-07 Wed 09:00-09:15 +1w>
+<2026-10-15 Thu 09:00-09:15>
+[2026-10-19 Mon 09:00] cancelled
+
+Summary: Standup
+
+
+
+Summary: Standup (moved)
+
+
+
+** busy
+:PROPERTIES:
+:ID:       b1@google.com
+:GCALLINK: https://x/b1
+:SEQUENCE: 0
+:END:
+
+<2026-10-17 Sat 08:00-09:00>
+
+Summary: 
+
+
+
+** Review
+:PROPERTIES:
+:ID:       r1@google.com
+:GCALLINK: https://x/r1
+:CREATOR: [[mailto:boss@x.com][The {Boss}]]
+:ORGANIZER: [[mailto:boss@x.com][]]
+:SEQUENCE: 0
+:END:
+
+<2026-10-19 Mon 10:00-11:30>
+Attendees:
+ ✓ [[mailto:boss@x.com][The {Boss}]]
+ ✓ [[mailto:me@x.com][me@x.com]]
+
+Summary: Review
+see {{https://x.com}{the doc}}
+,* not a heading
+
+
+Attachments:
+- [[https://x/f][Slides {v2}]]
+
+** /TODO/ planning
+:PROPERTIES:
+:ID:       d1@google.com
+:GCALLINK: https://x/d1
+:SEQUENCE: 0
+:END:
+
+[2026-10-20 Tue 14:00-15:00]
+Attendees:
+ ✓ [[mailto:boss@x.com][The {Boss}]]
+ ✗ [[mailto:me@x.com][me@x.com]]
+
+Summary: TODO planning
+
+
+
+** Trip
+:PROPERTIES:
+:ID:       t1@google.com
+:GCALLINK: https://x/t1
+:SEQUENCE: 0
+:END:
+
+<2026-10-22>--<2026-10-24>
+
+Summary: Trip
+
+
+
+`
+
+const goldenDay = `# -*- eval: (auto-revert-mode 1); -*-
+#+category: cal
+* 2026-10-05 Monday
+
+** Standup :WORK:
+:PROPERTIES:
+:ID:       w1@google.com
+:CALENDAR: me@x.com
+:GCALLINK: https://x/w1
+:SEQUENCE: 0
+:END:
+
+<2026-10-05 Mon 09:00-09:15 +1w>
+<2026-10-07 Wed 09:00-09:15 +1w>
+<2026-10-15 Thu 09:00-09:15>
+[2026-10-19 Mon 09:00] cancelled
+
+Summary: Standup
+
+
+
+Summary: Standup (moved)
+
+
+
+* 2026-10-17 Saturday
+
+** busy :WORK:
+:PROPERTIES:
+:ID:       b1@google.com
+:CALENDAR: me@x.com
+:GCALLINK: https://x/b1
+:SEQUENCE: 0
+:END:
+
+<2026-10-17 Sat 08:00-09:00>
+
+Summary: 
+
+
+
+* 2026-10-19 Monday
+
+** Review :WORK:
+:PROPERTIES:
+:ID:       r1@google.com
+:CALENDAR: me@x.com
+:GCALLINK: https://x/r1
+:CREATOR: [[mailto:boss@x.com][The {Boss}]]
+:ORGANIZER: [[mailto:boss@x.com][]]
+:SEQUENCE: 0
+:END:
+
+<2026-10-19 Mon 10:00-11:30>
+Attendees:
+ ✓ [[mailto:boss@x.com][The {Boss}]]
+ ✓ [[mailto:me@x.com][me@x.com]]
+
+Summary: Review
+see {{https://x.com}{the doc}}
+,* not a heading
+
+
+Attachments:
+- [[https://x/f][Slides {v2}]]
+
+* 2026-10-20 Tuesday
+
+** /TODO/ planning :WORK:
+:PROPERTIES:
+:ID:       d1@google.com
+:CALENDAR: me@x.com
+:GCALLINK: https://x/d1
+:SEQUENCE: 0
+:END:
+
+[2026-10-20 Tue 14:00-15:00]
+Attendees:
+ ✓ [[mailto:boss@x.com][The {Boss}]]
+ ✗ [[mailto:me@x.com][me@x.com]]
+
+Summary: TODO planning
+
+
+
+* 2026-10-22 Thursday
+
+** Trip :WORK:
+:PROPERTIES:
+:ID:       t1@google.com
+:CALENDAR: me@x.com
+:GCALLINK: https://x/t1
+:SEQUENCE: 0
+:END:
+
+<2026-10-22>--<2026-10-24>
+
+Summary: Trip
+
+
+
+`
+
+func TestDefaultTemplates(t *testing.T) {
+	inUTC(t)
+	tmpl, err := (&templateConfig{}).templates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		group string
+		want  string
+	}{
+		{groupCalendar, goldenCalendar},
+		{groupDay, goldenDay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.group, func(t *testing.T) {
+			l := layout{
+				order: orderStart,
+				group: tt.group,
+				now:   time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC),
+				tmpl:  tmpl,
+			}
+			var buf bytes.Buffer
+			if err := tmpl.writeHeader(&buf, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := l.printEvents(&buf, goldenResults()); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalendarTemplateTag(t *testing.T) {
+	tmpl, err := (&templateConfig{}).templates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &calendar.CalendarListEntry{Id: "me@x.com", Summary: "Me"}
+	tests := []struct {
+		tag  string
+		want string
+	}{
+		{"WORK", "* Me :WORK:"},
+		{"", "* Me"},
+	}
+	for _, tt := range tests {
+		cd := &calendarData{conf: &calendarConfig{ID: entry.Id, Tag: tt.tag}, entry: entry}
+		var buf bytes.Buffer
+		if err := tmpl.writeCalendar(&buf, &account{Name: "work"}, cd); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.SplitN(buf.String(), "\n", 2)[0]; got != tt.want {
+			t.Errorf("tag %q: heading %q, want %q", tt.tag, got, tt.want)
+		}
+	}
+}
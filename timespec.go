@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The export window used when neither the flags nor the config set one.
+const (
+	defaultFrom = "-9m"
+	defaultTo   = "+1y"
+)
+
+// timeWindow is the span of time events are exported for.
+type timeWindow struct {
+	min, max time.Time
+}
+
+func (w timeWindow) String() string {
+	return fmt.Sprintf("%s to %s", w.min.Format(time.RFC3339), w.max.Format(time.RFC3339))
+}
+
+// apiMin and apiMax format the window the way Events.List wants it.
+func (w timeWindow) apiMin() string { return w.min.UTC().Format(time.RFC3339) }
+func (w timeWindow) apiMax() string { return w.max.UTC().Format(time.RFC3339) }
+
+// startOfDay returns midnight of t's day in t's location.
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// parseTimeSpec parses a point in time given on the command line or in the
+// config. It accepts
+//
+//	now, today, tomorrow, yesterday
+//	+90d, -2w, +3m, -1y   days, weeks, months or years from today
+//	2026-10-17            midnight local time of that day
+//	2026-10-17T09:30      local time
+//	2026-10-17T09:30:00Z  RFC 3339
+//
+// Relative specs count from the start of today, so the window stays the same
+// for a whole day.
+func parseTimeSpec(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	today := startOfDay(now)
+	switch s {
+	case "now":
+		return now, nil
+	case "today":
+		return today, nil
+	case "tomorrow":
+		return today.AddDate(0, 0, 1), nil
+	case "yesterday":
+		return today.AddDate(0, 0, -1), nil
+	case "":
+		return time.Time{}, fmt.Errorf("empty time")
+	}
+
+	if s[0] == '+' || s[0] == '-' {
+		if len(s) < 3 {
+			return time.Time{}, fmt.Errorf("bad relative time %q", s)
+		}
+		n, err := strconv.Atoi(s[1 : len(s)-1])
+		if err != nil || n < 0 {
+			return time.Time{}, fmt.Errorf("bad relative time %q", s)
+		}
+		if s[0] == '-' {
+			n = -n
+		}
+		switch s[len(s)-1] {
+		case 'd':
+			return today.AddDate(0, 0, n), nil
+		case 'w':
+			return today.AddDate(0, 0, 7*n), nil
+		case 'm':
+			return today.AddDate(0, n, 0), nil
+		case 'y':
+			return today.AddDate(n, 0, 0), nil
+		}
+		return time.Time{}, fmt.Errorf("bad unit in relative time %q (want d, w, m or y)", s)
+	}
+
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", s)
+}
+
+// parseWindow parses a from/to pair into a window.
+func parseWindow(from, to string, now time.Time) (timeWindow, error) {
+	min, err := parseTimeSpec(from, now)
+	if err != nil {
+		return timeWindow{}, err
+	}
+	max, err := parseTimeSpec(to, now)
+	if err != nil {
+		return timeWindow{}, err
+	}
+	if !min.Before(max) {
+		return timeWindow{}, fmt.Errorf("window %s to %s is empty", from, to)
+	}
+	return timeWindow{min, max}, nil
+}
+
+// window returns the export window for cal of account a. The --from and --to
+// flags win over the calendar's own setting, which wins over the account's,
+// which wins over the global one.
+func (c *config) window(a *account, cal *calendarConfig, fromFlag, toFlag string, now time.Time) (timeWindow, error) {
+	pick := func(flag, calSpec, acctSpec, globalSpec, def string) string {
+		for _, s := range []string{flag, calSpec, acctSpec, globalSpec} {
+			if s != "" {
+				return s
+			}
+		}
+		return def
+	}
+	from := pick(fromFlag, cal.From, a.From, c.From, defaultFrom)
+	to := pick(toFlag, cal.To, a.To, c.To, defaultTo)
+	w, err := parseWindow(from, to, now)
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("calendar %s: %v", cal.ID, err)
+	}
+	return w, nil
+}
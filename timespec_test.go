@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeSpec(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	now := time.Date(2026, 10, 17, 15, 30, 0, 0, berlin)
+	tests := []struct {
+		spec    string
+		want    time.Time
+		wantErr bool
+	}{
+		{spec: "now", want: now},
+		{spec: "today", want: time.Date(2026, 10, 17, 0, 0, 0, 0, berlin)},
+		{spec: " tomorrow ", want: time.Date(2026, 10, 18, 0, 0, 0, 0, berlin)},
+		{spec: "yesterday", want: time.Date(2026, 10, 16, 0, 0, 0, 0, berlin)},
+		{spec: "+90d", want: time.Date(2027, 1, 15, 0, 0, 0, 0, berlin)},
+		{spec: "-2w", want: time.Date(2026, 10, 3, 0, 0, 0, 0, berlin)},
+		{spec: "-9m", want: time.Date(2026, 1, 17, 0, 0, 0, 0, berlin)},
+		{spec: "+1y", want: time.Date(2027, 10, 17, 0, 0, 0, 0, berlin)},
+		{spec: "2026-12-24", want: time.Date(2026, 12, 24, 0, 0, 0, 0, berlin)},
+		{spec: "2026-12-24T09:30", want: time.Date(2026, 12, 24, 9, 30, 0, 0, berlin)},
+		{spec: "2026-12-24T09:30:15", want: time.Date(2026, 12, 24, 9, 30, 15, 0, berlin)},
+		{spec: "2026-12-24T09:30:00Z", want: time.Date(2026, 12, 24, 9, 30, 0, 0, time.UTC)},
+		{spec: "2026-12-24T09:30:00-05:00", want: time.Date(2026, 12, 24, 14, 30, 0, 0, time.UTC)},
+		{spec: "", wantErr: true},
+		{spec: "+d", wantErr: true},
+		{spec: "+3x", wantErr: true},
+		{spec: "+-3d", wantErr: true},
+		{spec: "next week", wantErr: true},
+		{spec: "2026-13-01", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseTimeSpec(tt.spec, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseTimeSpec(%q) = %v, want an error", tt.spec, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTimeSpec(%q): %v", tt.spec, err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseTimeSpec(%q) = %v, want %v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigWindow(t *testing.T) {
+	inUTC(t)
+	now := time.Date(2026, 10, 17, 15, 30, 0, 0, time.UTC)
+	day := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name             string
+		conf             config
+		acct             account
+		cal              calendarConfig
+		fromFlag, toFlag string
+		wantMin, wantMax time.Time
+		wantErr          bool
+	}{
+		{
+			name:    "default",
+			wantMin: day(2026, 1, 17), wantMax: day(2027, 10, 17),
+		},
+		{
+			name:    "global",
+			conf:    config{From: "-1m", To: "+1m"},
+			wantMin: day(2026, 9, 17), wantMax: day(2026, 11, 17),
+		},
+		{
+			name:    "account",
+			conf:    config{From: "-1m", To: "+1m"},
+			acct:    account{From: "-2w"},
+			wantMin: day(2026, 10, 3), wantMax: day(2026, 11, 17),
+		},
+		{
+			name:    "calendar",
+			conf:    config{From: "-1m", To: "+1m"},
+			acct:    account{From: "-2w", To: "+2w"},
+			cal:     calendarConfig{To: "+3y"},
+			wantMin: day(2026, 10, 3), wantMax: day(2029, 10, 17),
+		},
+		{
+			name:     "flags",
+			conf:     config{From: "-1m", To: "+1m"},
+			acct:     account{From: "-2w", To: "+2w"},
+			cal:      calendarConfig{From: "-1y", To: "+3y"},
+			fromFlag: "today", toFlag: "2026-12-01",
+			wantMin: day(2026, 10, 17), wantMax: day(2026, 12, 1),
+		},
+		{
+			name:    "empty",
+			acct:    account{From: "+1y"},
+			cal:     calendarConfig{To: "today"},
+			wantErr: true,
+		},
+		{
+			name:    "bad spec",
+			cal:     calendarConfig{From: "soon"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cal.ID = "me@x.com"
+			got, err := tt.conf.window(&tt.acct, &tt.cal, tt.fromFlag, tt.toFlag, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("window() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("window(): %v", err)
+			}
+			if !got.min.Equal(tt.wantMin) || !got.max.Equal(tt.wantMax) {
+				t.Errorf("window() = %v, want %v", got, timeWindow{tt.wantMin, tt.wantMax})
+			}
+		})
+	}
+}
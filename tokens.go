@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/calendar/v3"
+)
+
+// tokenConfig says where oauth tokens are kept.
+type tokenConfig struct {
+	// Store is "file" (the default), "keyring" for the Secret Service
+	// keyring, or "encrypted" for files encrypted with age or a passphrase.
+	Store string `toml:"store"`
+
+	// AgeIdentity and AgeRecipient are the age key files encrypted tokens
+	// are decrypted and encrypted with. Without them the passphrase in
+	// $GCALORG_TOKEN_PASSPHRASE is used.
+	AgeIdentity  string `toml:"age_identity"`
+	AgeRecipient string `toml:"age_recipient"`
+}
+
+// Token stores.
+const (
+	fileTokens      = "file"
+	keyringTokens   = "keyring"
+	encryptedTokens = "encrypted"
+)
+
+// passphraseEnv names the variable holding the token passphrase.
+const passphraseEnv = "GCALORG_TOKEN_PASSPHRASE"
+
+// storedToken is an oauth token and the scopes it was granted.
+type storedToken struct {
+	oauth2.Token
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// tokenStore keeps the oauth tokens of accounts. load returns an error
+// wrapping os.ErrNotExist if it has no token by that name.
+type tokenStore interface {
+	load(name string) (*storedToken, error)
+	save(name string, tok *storedToken) error
+	remove(name string) error
+	where(name string) string
+}
+
+// store returns the token store c describes. Key paths are relative to base.
+func (c *tokenConfig) store(base string) (tokenStore, error) {
+	if c.Store != encryptedTokens && (c.AgeIdentity != "" || c.AgeRecipient != "") {
+		return nil, fmt.Errorf("tokens: age keys are for the encrypted store")
+	}
+	switch c.Store {
+	case "", fileTokens:
+		c.Store = fileTokens
+		dir, err := tokenDir()
+		if err != nil {
+			return nil, err
+		}
+		return fileStore{dir}, nil
+	case keyringTokens:
+		return keyringStore{}, nil
+	case encryptedTokens:
+		if (c.AgeIdentity == "") != (c.AgeRecipient == "") {
+			return nil, fmt.Errorf("tokens: age_identity and age_recipient go together")
+		}
+		dir, err := tokenDir()
+		if err != nil {
+			return nil, err
+		}
+		s := encryptedStore{dir: dir}
+		if c.AgeIdentity != "" {
+			s.identity = expandPath(c.AgeIdentity, base)
+			s.recipient = expandPath(c.AgeRecipient, base)
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("tokens: unknown store %q, want %q, %q or %q",
+			c.Store, fileTokens, keyringTokens, encryptedTokens)
+	}
+}
+
+// tokenDir returns $XDG_STATE_HOME/gcalorg/tokens.
+func tokenDir() (string, error) {
+	dir, err := xdgDir("XDG_STATE_HOME", filepath.Join(".local", "state"))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "gcalorg", "tokens"), nil
+}
+
+// readPrivateFile reads a file holding secrets, refusing it if other users
+// could read it too.
+func readPrivateFile(path string) ([]byte, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		return nil, fmt.Errorf("%s is accessible by other users (mode %#o), chmod 600 it", path, perm)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// fileStore keeps each token in a plain json file only we can read.
+type fileStore struct {
+	dir string
+}
+
+func (s fileStore) path(name string) string {
+	return filepath.Join(s.dir, url.PathEscape(name)+".json")
+}
+
+func (s fileStore) load(name string) (*storedToken, error) {
+	b, err := readPrivateFile(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return decodeToken(b)
+}
+
+func (s fileStore) save(name string, tok *storedToken) error {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(name), append(b, '\n'), 0600)
+}
+
+func (s fileStore) remove(name string) error { return os.Remove(s.path(name)) }
+
+func (s fileStore) where(name string) string { return s.path(name) }
+
+// keyringStore keeps tokens in the Secret Service keyring (gnome-keyring,
+// kwallet, keepassxc), talking to it with secret-tool.
+type keyringStore struct{}
+
+func (keyringStore) attrs(name string) []string {
+	return []string{"service", "gcalorg", "account", name}
+}
+
+func (s keyringStore) load(name string) (*storedToken, error) {
+	out, err := secretTool(nil, append([]string{"lookup"}, s.attrs(name)...)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no token for %s in the keyring: %w", name, os.ErrNotExist)
+	}
+	return decodeToken(out)
+}
+
+func (s keyringStore) save(name string, tok *storedToken) error {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	args := append([]string{"store", "--label=gcalorg token for " + name}, s.attrs(name)...)
+	_, err = secretTool(b, args...)
+	return err
+}
+
+func (s keyringStore) remove(name string) error {
+	_, err := secretTool(nil, append([]string{"clear"}, s.attrs(name)...)...)
+	return err
+}
+
+func (keyringStore) where(name string) string {
+	return fmt.Sprintf("the keyring (service gcalorg, account %s)", name)
+}
+
+// secretTool runs secret-tool with stdin as its input. A lookup that finds
+// nothing isn't an error, it just has no output.
+func secretTool(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("secret-tool", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && args[0] == "lookup" && len(out) == 0 && stderr.Len() == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("secret-tool %s: %w", args[0], err)
+	}
+	return out, nil
+}
+
+// encryptedStore keeps tokens in files encrypted to an age key, or with a
+// passphrase if it has no age keys.
+type encryptedStore struct {
+	dir       string
+	identity  string
+	recipient string
+}
+
+func (s encryptedStore) path(name string) string {
+	ext := ".json.enc"
+	if s.identity != "" {
+		ext = ".json.age"
+	}
+	return filepath.Join(s.dir, url.PathEscape(name)+ext)
+}
+
+func (s encryptedStore) load(name string) (*storedToken, error) {
+	path := s.path(name)
+	b, err := readPrivateFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if s.identity != "" {
+		b, err = runAge(b, "-d", "-i", s.identity)
+	} else {
+		b, err = decryptPassphrase(b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt %s: %w", path, err)
+	}
+	return decodeToken(b)
+}
+
+func (s encryptedStore) save(name string, tok *storedToken) error {
+	b, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	if s.identity != "" {
+		b, err = runAge(b, "-e", "-R", s.recipient)
+	} else {
+		b, err = encryptPassphrase(b)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to encrypt token: %w", err)
+	}
+	return writeFileAtomic(s.path(name), b, 0600)
+}
+
+func (s encryptedStore) remove(name string) error { return os.Remove(s.path(name)) }
+
+func (s encryptedStore) where(name string) string { return s.path(name) }
+
+// runAge runs the age binary on in.
+func runAge(in []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("age", args...)
+	cmd.Stdin = bytes.NewReader(in)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("age: %w", err)
+	}
+	return out, nil
+}
+
+// sealedToken is a token encrypted with a passphrase: AES-256-GCM with a key
+// derived by PBKDF2-SHA256.
+type sealedToken struct {
+	Version int    `json:"version"`
+	Iter    int    `json:"iter"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+const sealIter = 600000
+
+func passphraseAEAD(salt []byte, iter int) (cipher.AEAD, error) {
+	pass := os.Getenv(passphraseEnv)
+	if pass == "" {
+		return nil, fmt.Errorf("$%s isn't set", passphraseEnv)
+	}
+	key, err := pbkdf2.Key(sha256.New, pass, salt, iter, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptPassphrase(plain []byte) ([]byte, error) {
+	s := sealedToken{Version: 1, Iter: sealIter, Salt: make([]byte, 16)}
+	if _, err := rand.Read(s.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := passphraseAEAD(s.Salt, s.Iter)
+	if err != nil {
+		return nil, err
+	}
+	s.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(s.Nonce); err != nil {
+		return nil, err
+	}
+	s.Data = aead.Seal(nil, s.Nonce, plain, nil)
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func decryptPassphrase(sealed []byte) ([]byte, error) {
+	var s sealedToken
+	if err := json.Unmarshal(sealed, &s); err != nil {
+		return nil, err
+	}
+	if s.Version != 1 {
+		return nil, fmt.Errorf("unknown format version %d", s.Version)
+	}
+	aead, err := passphraseAEAD(s.Salt, s.Iter)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, s.Nonce, s.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or corrupted file")
+	}
+	return plain, nil
+}
+
+func decodeToken(b []byte) (*storedToken, error) {
+	tok := &storedToken{}
+	if err := json.Unmarshal(b, tok); err != nil {
+		return nil, fmt.Errorf("bad token: %w", err)
+	}
+	return tok, nil
+}
+
+// legacyTokenFile is where versions before the token store kept the
+// account's token, named after the client secret the way the quickstart
+// sample did.
+func legacyTokenFile(acct *account) (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("calendar-api-quickstart.%s.json", filepath.Base(acct.Secret))
+	return filepath.Join(usr.HomeDir, ".credentials", url.QueryEscape(name)), nil
+}
+
+// legacyScopes are the scopes tokens from before scopes were tracked were
+// granted: those versions only ever asked for read access.
+var legacyScopes = []string{calendar.CalendarReadonlyScope}
+
+// loadToken returns the account's token. Tokens from before scopes were
+// tracked are brought up to date, and if the store has none yet, a legacy
+// token file is imported.
+func loadToken(acct *account) (*storedToken, error) {
+	tok, err := acct.tokens.load(acct.Name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, authError(fmt.Errorf("unable to load token: %w", err))
+	}
+	if err == nil && len(tok.Scopes) > 0 {
+		return tok, nil
+	}
+
+	if err == nil {
+		tok.Scopes = legacyScopes
+		if err := acct.tokens.save(acct.Name, tok); err != nil {
+			return nil, authError(fmt.Errorf("unable to save token: %w", err))
+		}
+		return tok, nil
+	}
+
+	imported, ierr := importLegacyToken(acct)
+	if ierr != nil {
+		return nil, ierr
+	}
+	if imported == "" {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "%s: imported token from %s, delete it with 'gcalorg migrate --remove'\n",
+		acct.Name, imported)
+	return acct.tokens.load(acct.Name)
+}
+
+// importLegacyToken copies the account's legacy token file into the token
+// store, and returns its path. The path is empty if there is none.
+func importLegacyToken(acct *account) (string, error) {
+	path, err := legacyTokenFile(acct)
+	if err != nil {
+		return "", nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", authError(fmt.Errorf("unable to read legacy token: %w", err))
+	}
+	tok, err := decodeToken(b)
+	if err != nil {
+		return "", authError(fmt.Errorf("%s: %w", path, err))
+	}
+	tok.Scopes = legacyScopes
+	if err := acct.tokens.save(acct.Name, tok); err != nil {
+		return "", authError(fmt.Errorf("unable to save token: %w", err))
+	}
+	return path, nil
+}
+
+var migrateCmd = &command{
+	name:  "migrate",
+	args:  "[flags]",
+	short: "import tokens from ~/.credentials into the token store",
+	long: `
+Migrate imports the tokens older versions kept in
+~/.credentials/calendar-api-quickstart.*.json into the configured token
+store, for accounts that don't have one there yet. With --remove the old
+files are deleted once every account using them has a token in the store.
+
+Tokens are imported automatically when an account has none in the store,
+so this is mostly for moving them all at once and cleaning up.
+`,
+	run: runMigrate,
+}
+
+func runMigrate(cmd *command, args []string) error {
+	fs := cmd.flags()
+	configPath := configFlag(fs)
+	accountNames := fs.String("account", "", "comma separated accounts to migrate (default all)")
+	remove := fs.Bool("remove", false, "delete the old token files after importing them")
+	if err := cmd.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usageError(fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " ")))
+	}
+
+	conf, err := loadConfig(*configPath)
+	if err != nil {
+		return configError(err)
+	}
+	accts, err := conf.selectAccounts(*accountNames)
+	if err != nil {
+		return configError(err)
+	}
+
+	// Accounts sharing a client secret shared the token files too, so they
+	// are only removed once all of them have a token in the store.
+	var legacy []string
+	for _, acct := range accts {
+		if acct.Type != oauthAccount {
+			continue
+		}
+		path, err := legacyTokenFile(acct)
+		if err != nil {
+			return err
+		}
+		legacy = append(legacy, path)
+		_, err = acct.tokens.load(acct.Name)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return authError(fmt.Errorf("%s: %w", acct.Name, err))
+		}
+		imported, err := importLegacyToken(acct)
+		if err != nil {
+			return fmt.Errorf("%s: %w", acct.Name, err)
+		}
+		if imported != "" {
+			fmt.Fprintf(os.Stderr, "%s: imported %s into %s\n", acct.Name, imported, acct.tokens.where(acct.Name))
+		}
+	}
+	if !*remove {
+		return nil
+	}
+	removed := make(map[string]bool)
+	for _, path := range legacy {
+		if removed[path] {
+			continue
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		if other := legacyTokenUser(conf, path); other != "" {
+			fmt.Fprintf(os.Stderr, "kept %s, %s still uses it\n", path, other)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed[path] = true
+		fmt.Fprintf(os.Stderr, "removed %s\n", path)
+	}
+	return nil
+}
+
+// legacyTokenUser returns the name of an account that still needs the legacy
+// token file path, having no token of its own in the store.
+func legacyTokenUser(conf *config, path string) string {
+	for _, acct := range conf.Accounts {
+		if acct.Type != oauthAccount {
+			continue
+		}
+		if p, err := legacyTokenFile(acct); err != nil || p != path {
+			continue
+		}
+		if _, err := acct.tokens.load(acct.Name); errors.Is(err, os.ErrNotExist) {
+			return acct.Name
+		}
+	}
+	return ""
+}
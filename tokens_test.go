@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestPassphraseStore(t *testing.T) {
+	s := encryptedStore{dir: t.TempDir()}
+	tok := &storedToken{
+		Token:  oauth2.Token{AccessToken: "a", RefreshToken: "r", TokenType: "Bearer"},
+		Scopes: []string{"calendar"},
+	}
+	t.Setenv(passphraseEnv, "correct horse")
+	if err := s.save("work", tok); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(s.path("work"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), `"r"`) {
+		t.Errorf("the refresh token is in the clear:\n%s", b)
+	}
+
+	tests := []struct {
+		name    string
+		pass    string
+		mode    os.FileMode
+		wantErr string
+	}{
+		{name: "round trip", pass: "correct horse", mode: 0600},
+		{name: "wrong passphrase", pass: "battery staple", mode: 0600, wantErr: "wrong passphrase"},
+		{name: "no passphrase", mode: 0600, wantErr: passphraseEnv},
+		{name: "readable by others", pass: "correct horse", mode: 0644, wantErr: "chmod 600"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(passphraseEnv, tt.pass)
+			if err := os.Chmod(s.path("work"), tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.load("work")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("load() = %+v, %v, want an error mentioning %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("load(): %v", err)
+			}
+			if !reflect.DeepEqual(got, tok) {
+				t.Errorf("load() = %+v, want %+v", got, tok)
+			}
+		})
+	}
+}